@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"flag"
 	"log/slog"
@@ -8,6 +9,7 @@ import (
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
 	"gobgp-evpn-agent/internal/agent"
 	"gobgp-evpn-agent/internal/config"
@@ -33,6 +35,7 @@ func main() {
 
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
+	go watchConfig(ctx, *cfgPath, ag)
 
 	if err := ag.Run(ctx); err != nil {
 		slog.Error("agent exited with error", "err", err)
@@ -40,6 +43,51 @@ func main() {
 	}
 }
 
+// configPollInterval is how often the config file is checked for changes,
+// such as a ConfigMap update propagated into the pod.
+const configPollInterval = 10 * time.Second
+
+// watchConfig hands the config to the agent again on SIGHUP or when the
+// file's content changes.
+func watchConfig(ctx context.Context, path string, ag *agent.Agent) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+	last, _ := os.ReadFile(path)
+	for {
+		force := false
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			force = true
+		case <-ticker.C:
+		}
+		b, err := os.ReadFile(path)
+		if err != nil {
+			slog.Warn("read config failed", "path", path, "err", err)
+			continue
+		}
+		if !force && bytes.Equal(b, last) {
+			continue
+		}
+		last = b
+		cfg, err := config.Load(path)
+		if err != nil {
+			slog.Error("reload config failed, keeping current config", "err", err)
+			continue
+		}
+		setupLogger(cfg.LogLevel)
+		if err := ag.Reload(ctx, cfg); err != nil {
+			slog.Error("apply reloaded config failed", "err", err)
+			continue
+		}
+		slog.Info("config reloaded", "path", path)
+	}
+}
+
 func setupLogger(level string) {
 	lvl := slog.LevelInfo
 	switch strings.ToLower(level) {
@@ -7,6 +7,7 @@ import (
 	"io"
 	"net"
 	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -14,9 +15,7 @@ import (
 	"github.com/osrg/gobgp/v3/pkg/apiutil"
 	apibgp "github.com/osrg/gobgp/v3/pkg/packet/bgp"
 	"github.com/vishvananda/netlink"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
-	"google.golang.org/grpc/keepalive"
+	"google.golang.org/protobuf/proto"
 	"log/slog"
 
 	"gobgp-evpn-agent/internal/config"
@@ -27,21 +26,91 @@ import (
 type Agent struct {
 	cfg            config.Config
 	localIP        net.IP
-	communityToVNI map[uint32]config.VNIConfig
+	routerID       net.IP
+	communityToVNI map[string]config.VNIConfig
+	rtToVNI        map[string]config.VNIConfig
 	idToVNI        map[uint32]config.VNIConfig
 	vxlanManagers  map[uint32]*vxlan.Manager
+	// L3 VNIs are static: they are only configured, never discovered.
+	l3VNIs     map[uint32]config.L3VNIConfig
+	l3rtToVNI  map[string]config.L3VNIConfig
+	l3Managers map[uint32]*vxlan.L3Manager
 	// dynamicVNI means VNI mapping is derived from local vxlan devices.
-	dynamicVNI  bool
-	mapMu       sync.Mutex
-	vniOnline   map[uint32]bool
-	mu          sync.Mutex
-	desiredMu   sync.Mutex
-	desired     map[uint32]map[string]struct{}
+	dynamicVNI bool
+	mapMu      sync.Mutex
+	// refreshMu serializes refreshDynamicVNIs, which runs on netlink events
+	// and on the periodic resync.
+	refreshMu sync.Mutex
+	// rdClashes records the discovered VNIs skipped because their derived
+	// RD equals that of another VNI. Guarded by refreshMu.
+	rdClashes map[uint32]uint32
+	// queue feeds VNIs to the reconcile workers; everything that may change
+	// a VNI's kernel state or announcements enqueues it.
+	queue     *workQueue
+	vniOnline map[uint32]bool
+	mu        sync.Mutex
+	// mtuWarned records the remote MTU last warned about per VNI and VTEP.
+	// Guarded by mu.
+	mtuWarned map[dampKey]uint16
+	// mismatch records the device mismatches last reported per VNI.
+	// Guarded by mu.
+	mismatch  map[uint32]string
+	desiredMu sync.Mutex
+	desired   map[uint32]map[string]remoteVTEP
+	// remoteMACs holds remote Type-2 bindings keyed by VNI and route key.
+	remoteMACs map[uint32]map[string]remoteMAC
+	// remotePrefixes holds remote Type-5 prefixes keyed by L3 VNI and route key.
+	remotePrefixes map[uint32]map[string]remotePrefix
+	// refs records which paths carry the entries of the three maps above.
+	refs *pathRefs
+	// familySkipped records, per L3 VNI, the remote prefixes already warned
+	// about for a VTEP of the other address family. Guarded by desiredMu.
+	familySkipped map[uint32]map[string]struct{}
+	// policy filters received paths; nil accepts everything.
+	policy *importPolicy
+	// damp holds back flapping local and remote memberships.
+	damp *damper
+	// Stale remote state retained across a control-plane loss (graceful
+	// restart), merged under the live state until staleDeadline.
+	staleDesired  map[uint32]map[string]remoteVTEP
+	staleMACs     map[uint32]map[string]remoteMAC
+	stalePrefixes map[uint32]map[string]remotePrefix
+	staleDeadline time.Time
+	// localPathMu guards the announced routes below and is held across the
+	// calls that change them and across an endpoint switch. It is taken
+	// after failoverMu and before mapMu, mu and statusMu.
 	localPathMu sync.Mutex
 	localPath   *api.Path
-	localComms  []uint32
-	conn        *grpc.ClientConn
-	client      api.GobgpApiClient
+	localComms  []string
+	// localRetryAt schedules another updateLocalPath after a failed
+	// announcement, backing off with localRetry; zero when none is due.
+	localRetryAt time.Time
+	localRetry   reconnectBackoff
+	// localIMET holds the per-VNI Type-3 routes announced in EVPN mode.
+	localIMET map[uint32]*api.Path
+	// localMACs holds the Type-2 routes announced per VNI, keyed by binding.
+	localMACs map[uint32]map[string]*api.Path
+	// localPrefixes holds the Type-5 routes announced per L3 VNI, keyed by prefix.
+	localPrefixes map[uint32]map[string]*api.Path
+	endpoints     []*endpoint
+	// bgpMu guards bgpCfg, the bgp section as of the last reload.
+	bgpMu  sync.Mutex
+	bgpCfg config.BGPConfig
+	// bgpReconcileMu serializes convergence of the speaker's peers.
+	bgpReconcileMu sync.Mutex
+	// failoverMu serializes endpoint switches with orphan withdrawals.
+	failoverMu sync.Mutex
+	// statusMu guards status, active, switched, sessionStarted and
+	// sessionCancel.
+	statusMu       sync.Mutex
+	status         Status
+	active         int
+	switched       bool
+	sessionStarted bool
+	sessionCancel  context.CancelFunc
+	// identity is the gobgpd the last session saw. Only the watch loop
+	// uses it.
+	identity gobgpdIdentity
 }
 
 // New constructs the agent and prepares static state.
@@ -49,43 +118,115 @@ func New(cfg config.Config) (*Agent, error) {
 	localIP := net.ParseIP(cfg.Node.LocalAddress)
 	if localIP == nil {
 		var err error
-		localIP, err = netutil.IPv4ForInterface(cfg.Node.LocalInterface)
+		if cfg.Node.AddressFamily == config.FamilyIPv6 {
+			localIP, err = netutil.IPv6ForInterface(cfg.Node.LocalInterface)
+		} else {
+			localIP, err = netutil.IPv4ForInterface(cfg.Node.LocalInterface)
+		}
 		if err != nil {
 			return nil, err
 		}
 	}
-	if localIP.To4() == nil {
-		return nil, fmt.Errorf("local IP must be IPv4")
+	if v4 := localIP.To4(); v4 != nil {
+		localIP = v4
+	}
+	// Auto-derived RDs are <router-id>:<vni>, which needs an IPv4 address.
+	routerID := net.ParseIP(cfg.Node.RouterID).To4()
+	if routerID == nil {
+		routerID = localIP.To4()
+	}
+	perVNI := cfg.Mode == config.ModeEVPN || cfg.MembershipAdvertisement == config.AdvertisePerVNI
+	if routerID == nil && perVNI && needsAutoRD(cfg) {
+		return nil, fmt.Errorf("node.routerId is required to derive route distinguishers on an IPv6 underlay")
 	}
 
-	communityToVNI := make(map[uint32]config.VNIConfig, len(cfg.VNIs))
+	communityToVNI := make(map[string]config.VNIConfig, len(cfg.VNIs))
+	rtToVNI := make(map[string]config.VNIConfig, len(cfg.VNIs))
 	idToVNI := make(map[uint32]config.VNIConfig, len(cfg.VNIs))
 	vxManagers := make(map[uint32]*vxlan.Manager, len(cfg.VNIs))
 	dynamicVNI := len(cfg.VNIs) == 0
 	if !dynamicVNI {
 		for _, v := range cfg.VNIs {
-			val, err := config.ParseCommunity(v.Community)
-			if err != nil {
-				return nil, err
-			}
-			if _, exists := communityToVNI[val]; exists {
-				return nil, fmt.Errorf("duplicate community %s across VNIs", v.Community)
+			switch cfg.Mode {
+			case config.ModeEVPN:
+				rt, err := config.ParseRouteTarget(v.RouteTarget)
+				if err != nil {
+					return nil, err
+				}
+				if _, exists := rtToVNI[rt.String()]; exists {
+					return nil, fmt.Errorf("duplicate route target %s across VNIs", v.RouteTarget)
+				}
+				rtToVNI[rt.String()] = v
+			default:
+				val, err := config.ParseMembership(cfg.CommunityEncoding, v.Community)
+				if err != nil {
+					return nil, err
+				}
+				if _, exists := communityToVNI[val]; exists {
+					return nil, fmt.Errorf("duplicate community %s across VNIs", v.Community)
+				}
+				communityToVNI[val] = v
 			}
-			communityToVNI[val] = v
 			idToVNI[v.ID] = v
 			vxManagers[v.ID] = vxlan.NewManager(v, cfg.Node.VXLANPort, localIP)
 		}
 	}
 
+	l3VNIs := make(map[uint32]config.L3VNIConfig, len(cfg.L3VNIs))
+	l3rtToVNI := make(map[string]config.L3VNIConfig, len(cfg.L3VNIs))
+	l3Managers := make(map[uint32]*vxlan.L3Manager, len(cfg.L3VNIs))
+	for _, v := range cfg.L3VNIs {
+		rt, err := config.ParseRouteTarget(v.RouteTarget)
+		if err != nil {
+			return nil, err
+		}
+		if _, exists := l3rtToVNI[rt.String()]; exists {
+			return nil, fmt.Errorf("duplicate route target %s across L3 VNIs", v.RouteTarget)
+		}
+		l3rtToVNI[rt.String()] = v
+		l3VNIs[v.ID] = v
+		l3Managers[v.ID] = vxlan.NewL3Manager(v)
+	}
+	policy, err := newImportPolicy(cfg.ImportPolicy)
+	if err != nil {
+		return nil, err
+	}
+
 	a := &Agent{
 		cfg:            cfg,
 		localIP:        localIP,
+		routerID:       routerID,
 		communityToVNI: communityToVNI,
+		rtToVNI:        rtToVNI,
 		idToVNI:        idToVNI,
 		vxlanManagers:  vxManagers,
+		l3VNIs:         l3VNIs,
+		l3rtToVNI:      l3rtToVNI,
+		l3Managers:     l3Managers,
 		dynamicVNI:     dynamicVNI,
+		queue:          newWorkQueue(),
+		rdClashes:      make(map[uint32]uint32),
 		vniOnline:      make(map[uint32]bool, len(vxManagers)),
-		desired:        make(map[uint32]map[string]struct{}),
+		mtuWarned:      make(map[dampKey]uint16),
+		mismatch:       make(map[uint32]string),
+		desired:        make(map[uint32]map[string]remoteVTEP),
+		remoteMACs:     make(map[uint32]map[string]remoteMAC),
+		remotePrefixes: make(map[uint32]map[string]remotePrefix),
+		refs:           newPathRefs(),
+		policy:         policy,
+		damp:           newDamper(cfg.Dampening),
+		staleDesired:   make(map[uint32]map[string]remoteVTEP),
+		staleMACs:      make(map[uint32]map[string]remoteMAC),
+		stalePrefixes:  make(map[uint32]map[string]remotePrefix),
+		familySkipped:  make(map[uint32]map[string]struct{}),
+		localIMET:      make(map[uint32]*api.Path),
+		localMACs:      make(map[uint32]map[string]*api.Path),
+		localPrefixes:  make(map[uint32]map[string]*api.Path),
+		bgpCfg:         cfg.BGP,
+		status:         Status{Endpoint: cfg.GoBGP.Endpoints[0], Since: time.Now()},
+	}
+	if cfg.BGP.Enabled {
+		a.status.Endpoint = embeddedAddress
 	}
 	if err := a.connect(); err != nil {
 		return nil, err
@@ -93,26 +234,23 @@ func New(cfg config.Config) (*Agent, error) {
 	return a, nil
 }
 
-func (a *Agent) connect() error {
-	ctx, cancel := context.WithTimeout(context.Background(), a.cfg.GoBGP.Timeout)
-	defer cancel()
-	conn, err := grpc.DialContext(
-		ctx,
-		a.cfg.GoBGP.Address,
-		grpc.WithTransportCredentials(insecure.NewCredentials()),
-		grpc.WithBlock(),
-		grpc.WithKeepaliveParams(keepalive.ClientParameters{
-			Time:                2 * time.Minute,
-			Timeout:             20 * time.Second,
-			PermitWithoutStream: true,
-		}),
-	)
-	if err != nil {
-		return fmt.Errorf("connect gobgp at %s: %w", a.cfg.GoBGP.Address, err)
+// needsAutoRD reports whether any VNI relies on a derived route distinguisher.
+// Dynamic VNIs never carry an RD.
+func needsAutoRD(cfg config.Config) bool {
+	if len(cfg.VNIs) == 0 {
+		return true
 	}
-	a.conn = conn
-	a.client = api.NewGobgpApiClient(conn)
-	return nil
+	for _, v := range cfg.VNIs {
+		if v.RD == "" {
+			return true
+		}
+	}
+	for _, v := range cfg.L3VNIs {
+		if v.RD == "" {
+			return true
+		}
+	}
+	return false
 }
 
 // Run blocks until context cancellation.
@@ -121,219 +259,535 @@ func (a *Agent) Run(ctx context.Context) error {
 		// Seed VNI map from existing vxlan links.
 		a.refreshDynamicVNIs(ctx)
 	}
-	// Initial probe: do not create vxlan, only update online state.
-	for vni := range a.vxlanManagers {
-		_ = a.ensureVNI(ctx, vni)
+	// Initial probe: create configured vxlan devices when enabled and
+	// queue every VNI so the workers settle its online state.
+	a.mapMu.Lock()
+	managers := make(map[uint32]*vxlan.Manager, len(a.vxlanManagers))
+	for vni, mgr := range a.vxlanManagers {
+		managers[vni] = mgr
 	}
-	// Periodic probe: detect manual vxlan create/delete at runtime.
-	go a.pollVxlan(ctx, 2*time.Second)
+	a.mapMu.Unlock()
+	for vni, mgr := range managers {
+		if a.cfg.Node.CreateVxlan && !a.dynamicVNI && linkMissing(mgr.LoadLink()) {
+			a.createVxlan(vni, mgr)
+		}
+		a.queue.add(vni)
+	}
+	for i := 0; i < a.cfg.Node.ReconcileWorkers; i++ {
+		go a.runWorker(ctx)
+	}
+	go func() {
+		<-ctx.Done()
+		a.queue.close()
+	}()
+	if a.cfg.StatusAddress != "" {
+		go a.serveStatus(ctx)
+	}
+	for _, ep := range a.endpoints {
+		go a.monitorConn(ctx, ep)
+	}
+	if len(a.endpoints) > 1 {
+		go a.preferEndpoints(ctx)
+	}
+	// Netlink events detect vxlan create/delete and FDB drift at runtime;
+	// the timers resync everything now and then.
+	go a.watchKernel(ctx)
+	go a.runTimers(ctx, 2*time.Second)
 	if a.cfg.AdvertiseSelf {
-		if err := a.advertiseSelf(ctx); err != nil {
-			return fmt.Errorf("announce self: %w", err)
+		// gobgpd may not be up yet; the first watch session retries.
+		if err := a.updateLocalPath(ctx); err != nil {
+			slog.Warn("announce self failed, will retry once connected", "err", err)
 		}
 	}
 
+	var bo reconnectBackoff
 	for {
-		if err := a.watchOnce(ctx); err != nil {
-			if errors.Is(err, context.Canceled) {
-				return nil
-			}
-			slog.Warn("watch stream ended, retrying", "err", err)
-			select {
-			case <-ctx.Done():
-				return nil
-			case <-time.After(2 * time.Second):
-			}
+		a.switchEndpoint(ctx, a.selectEndpoint(ctx))
+		sessCtx, cancel := context.WithCancel(ctx)
+		a.statusMu.Lock()
+		a.sessionCancel = cancel
+		a.statusMu.Unlock()
+		start := time.Now()
+		err := a.watchOnce(sessCtx)
+		failback := sessCtx.Err() != nil
+		cancel()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if failback {
+			// Ended by preferEndpoints to fail back; reselect right away.
+			a.setConnected(false, errors.New("failing back to preferred endpoint"))
 			continue
 		}
-		return nil
+		a.setConnected(false, err)
+		a.markStale()
+		if time.Since(start) > reconnectStableAfter {
+			bo.reset()
+		}
+		delay := bo.next()
+		slog.Warn("watch stream ended, retrying", "err", err, "in", delay)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
 	}
 }
 
 // Close releases resources.
 func (a *Agent) Close() {
-	if a.conn != nil {
-		_ = a.conn.Close()
+	for _, ep := range a.endpoints {
+		if ep.server != nil {
+			ep.server.Stop()
+		}
+		if ep.conn != nil {
+			_ = ep.conn.Close()
+		}
 	}
-	if a.cfg.Node.SkipLinkCleanup {
+	if a.cfg.Node.CleanupPolicy == config.CleanupNone {
 		return
 	}
-	for _, mgr := range a.vxlanManagers {
-		_ = mgr.Close()
+	a.mapMu.Lock()
+	managers := make(map[uint32]*vxlan.Manager, len(a.vxlanManagers))
+	for vni, mgr := range a.vxlanManagers {
+		managers[vni] = mgr
 	}
-}
-
-func (a *Agent) advertiseSelf(ctx context.Context) error {
-	for _, v := range a.cfg.VNIs {
-		if mgr := a.vxlanManagers[v.ID]; mgr != nil {
-			if err := mgr.LoadLink(); err != nil && !a.cfg.Node.AutoRecreateVxlan {
-				slog.Info("skip advertise, vxlan missing", "vni", v.ID, "dev", v.Device)
-				a.setOnline(v.ID, false)
-				continue
+	a.mapMu.Unlock()
+	for vni, mgr := range managers {
+		if a.cfg.Node.CleanupPolicy == config.CleanupDeleteOwned {
+			if err := mgr.Close(); err != nil {
+				slog.Warn("delete vxlan failed", "vni", vni, "err", err)
 			}
 		}
-		a.setOnline(v.ID, true)
+		if err := mgr.FlushFDB(); err != nil {
+			slog.Warn("flush fdb failed", "vni", vni, "err", err)
+		}
 	}
-	return a.updateLocalPath(ctx)
 }
 
+// sweepDelay bounds how long a watch session waits for its initial dump
+// before sweeping anyway.
+const sweepDelay = time.Second
+
 func (a *Agent) watchOnce(ctx context.Context) error {
-	stream, err := a.client.WatchEvent(ctx, &api.WatchEventRequest{
-		Table: &api.WatchEventRequest_Table{
-			Filters: []*api.WatchEventRequest_Table_Filter{
-				{
-					Type: api.WatchEventRequest_Table_Filter_BEST,
-					Init: true,
-				},
-			},
+	filters := []*api.WatchEventRequest_Table_Filter{
+		{
+			Type: api.WatchEventRequest_Table_Filter_BEST,
+			Init: true,
 		},
+	}
+	if a.cfg.MembershipPaths == config.MembershipAll {
+		// Every accepted path from every peer. Best paths still cover
+		// routes injected locally over the API, which have no peer.
+		filters = append(filters, &api.WatchEventRequest_Table_Filter{
+			Type: api.WatchEventRequest_Table_Filter_POST_POLICY,
+			Init: true,
+		})
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stream, err := a.gobgp().WatchEvent(ctx, &api.WatchEventRequest{
+		Table:     &api.WatchEventRequest_Table{Filters: filters},
 		BatchSize: 128,
 	})
 	if err != nil {
 		return fmt.Errorf("start watch: %w", err)
 	}
+	a.beginSession(ctx)
 
+	events := make(chan *api.WatchEventResponse)
+	recvErr := make(chan error, 1)
+	go func() {
+		for {
+			resp, err := stream.Recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+			select {
+			case events <- resp:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// The initial dump proves the watch is registered, so every change
+	// after the sweep's snapshot still arrives on the stream. An empty RIB
+	// sends no dump, so the sweep also runs once sweepDelay passes without
+	// an event; otherwise routes withdrawn while the stream was down would
+	// never be swept.
+	sweep := time.After(sweepDelay)
+	swept := false
 	for {
-		resp, err := stream.Recv()
-		if err != nil {
+		var resp *api.WatchEventResponse
+		select {
+		case err := <-recvErr:
 			if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
 				return err
 			}
 			return fmt.Errorf("watch recv: %w", err)
+		case <-sweep:
+		case resp = <-events:
+		}
+		if !swept {
+			if err := a.sweepSession(ctx); err != nil {
+				return fmt.Errorf("session resync: %w", err)
+			}
+			swept = true
 		}
 		table := resp.GetTable()
 		if table == nil {
 			continue
 		}
 		a.desiredMu.Lock()
-		touched := a.consumePaths(table.Paths, a.desired)
+		touched := a.consumePaths(table.Paths)
 		a.desiredMu.Unlock()
 		for vni := range touched {
-			if mgr := a.vxlanManagers[vni]; mgr != nil {
-				if !a.ensureVNI(ctx, vni) {
-					continue
-				}
-				if err := mgr.SyncFDB(a.snapshotDesired(vni)); err != nil {
-					if !errors.Is(err, netlink.LinkNotFoundError{}) {
-						slog.Error("sync fdb failed", "vni", vni, "err", err)
-					}
-				}
-			}
+			a.queue.add(vni)
 		}
 	}
 }
 
-func (a *Agent) consumePaths(paths []*api.Path, desired map[uint32]map[string]struct{}) map[uint32]struct{} {
+// consumePaths applies route updates to the remote state. Caller must hold
+// desiredMu.
+func (a *Agent) consumePaths(paths []*api.Path) map[uint32]struct{} {
 	touched := make(map[uint32]struct{})
 	for _, p := range paths {
 		if p == nil || p.Family == nil {
 			continue
 		}
-		if p.Family.Afi != api.Family_AFI_IP || p.Family.Safi != api.Family_SAFI_UNICAST {
-			continue
-		}
-		nlri, err := apiutil.GetNativeNlri(p)
+		key, err := a.pathKey(p)
 		if err != nil {
 			slog.Debug("skip path with bad nlri", "err", err)
 			continue
 		}
-		ipPrefix, ok := nlri.(*apibgp.IPAddrPrefix)
-		if !ok || ipPrefix.Length != 32 {
+		entries := a.pathEntries(p)
+		if p.IsWithdraw {
+			for _, id := range a.refs.set(key, nil) {
+				a.dropEntry(id)
+				touched[id.vni] = struct{}{}
+			}
+			// What the withdrawn route carried goes too unless another path
+			// still has it, including entries retained as stale.
+			for _, e := range entries {
+				if !a.refs.held(e.id()) {
+					a.dropEntry(e.id())
+					touched[e.vni] = struct{}{}
+				}
+			}
 			continue
 		}
-		ip := ipPrefix.Prefix.String()
-		if ip == a.localIP.String() {
-			continue
+		entries = a.importEntries(p, entries)
+		for _, id := range a.refs.set(key, entries) {
+			a.dropEntry(id)
+			touched[id.vni] = struct{}{}
+		}
+		for _, e := range entries {
+			a.applyEntry(e)
+			touched[e.vni] = struct{}{}
 		}
-		comms, err := extractCommunities(p)
+	}
+	return touched
+}
+
+// parseMembership maps a path to its remote VTEP address and the local VNIs
+// it is a member of, using community routes (host routes or per-VNI Type-3
+// routes, VTEP taken per vtepSource) or EVPN Type-3 routes matched by route
+// target.
+func (a *Agent) parseMembership(p *api.Path) (string, []uint32, bool) {
+	switch {
+	case (p.Family.Afi == api.Family_AFI_IP || p.Family.Afi == api.Family_AFI_IP6) && p.Family.Safi == api.Family_SAFI_UNICAST:
+		nlri, err := apiutil.GetNativeNlri(p)
 		if err != nil {
-			slog.Debug("skip path, cannot extract communities", "err", err)
-			continue
+			slog.Debug("skip path with bad nlri", "err", err)
+			return "", nil, false
 		}
-		for _, comm := range comms {
-			a.mapMu.Lock()
-			vniCfg, ok := a.communityToVNI[comm]
-			a.mapMu.Unlock()
-			if !ok {
-				continue
-			}
-			if desired[vniCfg.ID] == nil {
-				desired[vniCfg.ID] = make(map[string]struct{})
+		attrs, err := apiutil.GetNativePathAttributes(p)
+		if err != nil {
+			slog.Debug("skip path with bad attributes", "err", err)
+			return "", nil, false
+		}
+		vtep := membershipVTEP(a.cfg.VTEPSource, nlri, attrs)
+		if vtep == nil {
+			return "", nil, false
+		}
+		return a.communityMembership(p, vtep.String())
+	case p.Family.Afi == api.Family_AFI_L2VPN && p.Family.Safi == api.Family_SAFI_EVPN:
+		ip, rts, ok := parseIMETPath(p)
+		if !ok {
+			return "", nil, false
+		}
+		if a.cfg.Mode == config.ModeCommunity {
+			// A per-VNI membership route: the VTEP is the tunnel endpoint
+			// unless vtepSource points elsewhere.
+			if a.cfg.VTEPSource != config.VTEPSourcePrefix {
+				nlri, err := apiutil.GetNativeNlri(p)
+				if err != nil {
+					return "", nil, false
+				}
+				attrs, err := apiutil.GetNativePathAttributes(p)
+				if err != nil {
+					return "", nil, false
+				}
+				vtep := membershipVTEP(a.cfg.VTEPSource, nlri, attrs)
+				if vtep == nil {
+					return "", nil, false
+				}
+				ip = vtep.String()
 			}
-			if p.IsWithdraw {
-				delete(desired[vniCfg.ID], ip)
-			} else {
-				desired[vniCfg.ID][ip] = struct{}{}
+			return a.communityMembership(p, ip)
+		}
+		var vnis []uint32
+		a.mapMu.Lock()
+		for _, rt := range rts {
+			if vniCfg, ok := a.rtToVNI[rt]; ok {
+				vnis = append(vnis, vniCfg.ID)
 			}
-			touched[vniCfg.ID] = struct{}{}
 		}
+		a.mapMu.Unlock()
+		return ip, vnis, true
 	}
-	return touched
+	return "", nil, false
+}
+
+// communityMembership maps the membership communities of a path to local
+// VNIs.
+func (a *Agent) communityMembership(p *api.Path, vtep string) (string, []uint32, bool) {
+	comms, err := extractCommunities(p, a.cfg.CommunityEncoding)
+	if err != nil {
+		slog.Debug("skip path, cannot extract communities", "err", err)
+		return "", nil, false
+	}
+	var vnis []uint32
+	a.mapMu.Lock()
+	for _, comm := range comms {
+		if vniCfg, ok := a.communityToVNI[comm]; ok {
+			vnis = append(vnis, vniCfg.ID)
+		}
+	}
+	a.mapMu.Unlock()
+	return vtep, vnis, true
 }
 
 // ensureVNI ensures vxlan link exists if allowed; returns false if VNI is offline.
+// A VNI unregistered by refreshDynamicVNIs goes offline.
 func (a *Agent) ensureVNI(ctx context.Context, vni uint32) bool {
 	a.mapMu.Lock()
 	mgr := a.vxlanManagers[vni]
 	a.mapMu.Unlock()
 	if mgr == nil {
+		if a.swapOnline(vni, false) {
+			_ = a.updateLocalPath(ctx)
+		}
 		return false
 	}
-	if err := mgr.LoadLink(); err == nil {
-		if online, _ := a.getOnline(vni); !online {
+	err := mgr.LoadLink()
+	if linkMissing(err) && a.cfg.Node.AutoRecreateVxlan && !a.dynamicVNI {
+		if a.createVxlan(vni, mgr) {
+			err = nil
+		}
+	}
+	if err == nil {
+		err = a.checkVxlan(vni, mgr)
+	}
+	if err == nil {
+		if !a.swapOnline(vni, true) {
 			a.mapMu.Lock()
 			vCfg, ok := a.idToVNI[vni]
 			a.mapMu.Unlock()
 			if ok {
 				slog.Info("vxlan detected", "vni", vni, "dev", vCfg.Device)
 			}
-			a.setOnline(vni, true)
 			_ = a.updateLocalPath(ctx)
 		}
 		return true
 	}
 	// Link missing: withdraw membership and mark offline.
-	if online, _ := a.getOnline(vni); online {
+	if a.swapOnline(vni, false) {
 		a.mapMu.Lock()
 		vCfg, ok := a.idToVNI[vni]
 		a.mapMu.Unlock()
 		if ok {
 			slog.Info("vxlan removed", "vni", vni, "dev", vCfg.Device)
 		}
-		a.setOnline(vni, false)
+		a.damp.flap(dampKey{vni: vni})
 		_ = a.updateLocalPath(ctx)
 	}
 	return false
 }
 
-func (a *Agent) pollVxlan(ctx context.Context, interval time.Duration) {
+// createVxlan creates the configured device of a static VNI and reports
+// whether it now exists.
+func (a *Agent) createVxlan(vni uint32, mgr *vxlan.Manager) bool {
+	if err := mgr.Create(); err != nil {
+		slog.Warn("create vxlan failed", "vni", vni, "err", err)
+		return false
+	}
+	a.mapMu.Lock()
+	vCfg := a.idToVNI[vni]
+	a.mapMu.Unlock()
+	slog.Info("vxlan created", "vni", vni, "dev", vCfg.Device)
+	return true
+}
+
+// checkVxlan reports the attributes of the device that differ from the
+// configuration and, as node.repairMode allows, recreates it. A mismatch
+// is reported and repaired once; if recreating does not fix it, the
+// device is used as it is. It returns an error only when a repair left
+// the device missing.
+func (a *Agent) checkVxlan(vni uint32, mgr *vxlan.Manager) error {
+	reasons := mgr.Mismatches()
+	key := strings.Join(reasons, "; ")
+	a.mu.Lock()
+	last := a.mismatch[vni]
+	if key == "" {
+		delete(a.mismatch, vni)
+	} else {
+		a.mismatch[vni] = key
+	}
+	a.mu.Unlock()
+	if key == last {
+		return nil
+	}
+	a.mapMu.Lock()
+	dev := a.idToVNI[vni].Device
+	a.mapMu.Unlock()
+	if key == "" {
+		slog.Info("vxlan matches config", "vni", vni, "dev", dev)
+		return nil
+	}
+	for _, reason := range reasons {
+		slog.Warn("vxlan mismatch", "vni", vni, "dev", dev, "reason", reason)
+	}
+	switch {
+	case a.dynamicVNI:
+		return nil
+	case a.cfg.Node.RepairMode == config.RepairRecreate:
+	case a.cfg.Node.RepairMode == config.RepairRecreateOwned && mgr.Owned():
+	default:
+		return nil
+	}
+	if err := mgr.Recreate(); err != nil {
+		slog.Warn("repair vxlan failed", "vni", vni, "dev", dev, "err", err)
+		return mgr.LoadLink()
+	}
+	slog.Info("vxlan repaired", "vni", vni, "dev", dev)
+	// Some mismatches, like an MTU above what the underlay allows, survive
+	// recreation; record them so the device is not recreated again.
+	reasons = mgr.Mismatches()
+	for _, reason := range reasons {
+		slog.Warn("vxlan mismatch persists after repair", "vni", vni, "dev", dev, "reason", reason)
+	}
+	a.mu.Lock()
+	if len(reasons) == 0 {
+		delete(a.mismatch, vni)
+	} else {
+		a.mismatch[vni] = strings.Join(reasons, "; ")
+	}
+	a.mu.Unlock()
+	return nil
+}
+
+// autoRDClash reports the VNI whose derived RD a discovered vni would
+// share when VNIs are announced with RDs. mapMu must be held.
+func (a *Agent) autoRDClash(vni uint32) (uint32, bool) {
+	if !a.cfg.UsesRD() {
+		return 0, false
+	}
+	for id, v := range a.idToVNI {
+		if v.RD == "" && config.AutoRDIndex(id) == config.AutoRDIndex(vni) {
+			return id, true
+		}
+	}
+	for id, v := range a.l3VNIs {
+		if v.RD == "" && config.AutoRDIndex(id) == config.AutoRDIndex(vni) {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// linkMissing reports whether err says the link does not exist, as opposed
+// to it existing with the wrong type.
+func linkMissing(err error) bool {
+	var nf netlink.LinkNotFoundError
+	return errors.As(err, &nf)
+}
+
+// runTimers drives the time-based work: stale expiry, dampening reuse,
+// announcement retries and, every node.resyncInterval, a full resync as a
+// safety net for missed netlink events.
+func (a *Agent) runTimers(ctx context.Context, interval time.Duration) {
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
+	lastResync := time.Now()
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
-			if a.dynamicVNI {
-				a.refreshDynamicVNIs(ctx)
-			}
-			for vni := range a.vxlanManagers {
-				if !a.ensureVNI(ctx, vni) {
-					continue
-				}
-				if mgr := a.vxlanManagers[vni]; mgr != nil {
-					if err := mgr.SyncFDB(a.snapshotDesired(vni)); err != nil {
-						if !errors.Is(err, netlink.LinkNotFoundError{}) {
-							slog.Error("sync fdb failed", "vni", vni, "err", err)
-						}
-					}
-				}
+			a.expireStale(ctx)
+			a.releaseDampened(ctx)
+			a.retryLocalPath(ctx)
+			if time.Since(lastResync) >= a.cfg.Node.ResyncInterval {
+				a.resyncKernel(ctx)
+				lastResync = time.Now()
 			}
 		}
 	}
 }
 
+// syncVNI programs the flood list and, in EVPN mode, the unicast MAC
+// entries and suppression neighbors of an online VNI from the desired state.
+// L3 VNIs get their VRF routes programmed instead. A device that vanishes
+// meanwhile is not an error; its VNI goes offline on the next reconcile.
+func (a *Agent) syncVNI(ctx context.Context, vni uint32) error {
+	if l3 := a.l3Managers[vni]; l3 != nil {
+		return a.syncL3VNI(vni, l3)
+	}
+	a.mapMu.Lock()
+	mgr := a.vxlanManagers[vni]
+	a.mapMu.Unlock()
+	if !a.ensureVNI(ctx, vni) || mgr == nil {
+		return nil
+	}
+	remotes := a.snapshotDesired(vni)
+	ports := make(map[string]uint16, len(remotes))
+	for ip, r := range remotes {
+		ports[ip] = r.Port
+	}
+	a.warnRemoteMTU(vni, mgr.MTU(), remotes)
+	if err := mgr.SyncFDB(ports); err != nil && !linkMissing(err) {
+		return fmt.Errorf("sync fdb: %w", err)
+	}
+	if a.cfg.Mode != config.ModeEVPN {
+		return nil
+	}
+	if err := mgr.SyncMACs(a.snapshotMACs(vni)); err != nil && !linkMissing(err) {
+		return fmt.Errorf("sync mac fdb: %w", err)
+	}
+	a.mapMu.Lock()
+	vCfg := a.idToVNI[vni]
+	a.mapMu.Unlock()
+	if !vCfg.ARPSuppress {
+		if err := mgr.DisableNeighSuppress(); err != nil && !linkMissing(err) {
+			return fmt.Errorf("disable neigh suppress: %w", err)
+		}
+		return nil
+	}
+	if err := mgr.EnableNeighSuppress(); err != nil {
+		slog.Warn("enable neigh suppress failed", "vni", vni, "err", err)
+	}
+	if err := mgr.SyncNeighbors(a.snapshotNeighbors(vni)); err != nil && !linkMissing(err) {
+		return fmt.Errorf("sync neighbors: %w", err)
+	}
+	return nil
+}
+
 func (a *Agent) refreshDynamicVNIs(ctx context.Context) {
+	a.refreshMu.Lock()
+	defer a.refreshMu.Unlock()
 	links, err := netlink.LinkList()
 	if err != nil {
 		slog.Warn("list links failed", "err", err)
@@ -352,26 +806,51 @@ func (a *Agent) refreshDynamicVNIs(ctx context.Context) {
 			continue
 		}
 		present[vni] = struct{}{}
-		// Derive community from ASN:VNI convention.
-		community := fmt.Sprintf("%d:%d", a.cfg.CommunityASN, vni)
-		commVal, err := config.ParseCommunity(community)
-		if err != nil {
-			slog.Warn("invalid community for vni", "vni", vni, "community", community, "err", err)
-			continue
+		// Derive community (or route target in EVPN mode) from ASN:VNI convention.
+		vniCfg := config.VNIConfig{
+			ID:                vni,
+			Device:            l.Attrs().Name,
+			UnderlayInterface: a.cfg.Node.LocalInterface,
+		}
+		var community string
+		if a.cfg.Mode == config.ModeEVPN {
+			raw := fmt.Sprintf("%d:%d", a.cfg.CommunityASN, vni)
+			rt, err := config.ParseRouteTarget(raw)
+			if err != nil {
+				slog.Warn("invalid route target for vni", "vni", vni, "rt", raw, "err", err)
+				continue
+			}
+			vniCfg.RouteTarget = raw
+			community = rt.String()
+		} else {
+			raw := a.cfg.DefaultCommunity(vni)
+			community, err = config.ParseMembership(a.cfg.CommunityEncoding, raw)
+			if err != nil {
+				slog.Warn("invalid community for vni", "vni", vni, "community", raw, "encoding", a.cfg.CommunityEncoding, "err", err)
+				continue
+			}
+			vniCfg.Community = raw
 		}
 		a.mapMu.Lock()
 		if _, exists := a.idToVNI[vni]; exists {
 			a.mapMu.Unlock()
 			continue
 		}
-		vniCfg := config.VNIConfig{
-			ID:                vni,
-			Community:         community,
-			Device:            l.Attrs().Name,
-			UnderlayInterface: a.cfg.Node.LocalInterface,
+		if other, clash := a.autoRDClash(vni); clash {
+			a.mapMu.Unlock()
+			if a.rdClashes[vni] != other {
+				slog.Warn("skip vxlan vni, derived rd collides", "vni", vni, "dev", l.Attrs().Name, "with", other)
+				a.rdClashes[vni] = other
+			}
+			continue
+		}
+		delete(a.rdClashes, vni)
+		if a.cfg.Mode == config.ModeEVPN {
+			a.rtToVNI[community] = vniCfg
+		} else {
+			a.communityToVNI[community] = vniCfg
 		}
 		a.idToVNI[vni] = vniCfg
-		a.communityToVNI[commVal] = vniCfg
 		a.vxlanManagers[vni] = vxlan.NewManager(vniCfg, a.cfg.Node.VXLANPort, a.localIP)
 		a.mapMu.Unlock()
 		slog.Info("discovered vxlan vni", "vni", vni, "dev", l.Attrs().Name, "community", community)
@@ -379,18 +858,12 @@ func (a *Agent) refreshDynamicVNIs(ctx context.Context) {
 	}
 	if created {
 		// New VNI appeared; rebuild desired table from RIB and sync FDB.
-		touched := a.resyncRIB(ctx)
+		touched, err := a.resyncRIB(ctx)
+		if err != nil {
+			slog.Warn("resync rib failed", "err", err)
+		}
 		for vni := range touched {
-			if mgr := a.vxlanManagers[vni]; mgr != nil {
-				if !a.ensureVNI(ctx, vni) {
-					continue
-				}
-				if err := mgr.SyncFDB(a.snapshotDesired(vni)); err != nil {
-					if !errors.Is(err, netlink.LinkNotFoundError{}) {
-						slog.Error("sync fdb failed", "vni", vni, "err", err)
-					}
-				}
-			}
+			a.queue.add(vni)
 		}
 	}
 	// Remove VNIs that no longer exist on the host.
@@ -403,7 +876,6 @@ func (a *Agent) refreshDynamicVNIs(ctx context.Context) {
 	}
 	a.mapMu.Unlock()
 	for _, vni := range missing {
-		_ = a.ensureVNI(ctx, vni) // withdraw if needed
 		var dev string
 		a.mapMu.Lock()
 		if cfg, ok := a.idToVNI[vni]; ok {
@@ -416,49 +888,105 @@ func (a *Agent) refreshDynamicVNIs(ctx context.Context) {
 				break
 			}
 		}
+		for rt, cfg := range a.rtToVNI {
+			if cfg.ID == vni {
+				delete(a.rtToVNI, rt)
+				break
+			}
+		}
 		delete(a.vxlanManagers, vni)
 		a.mapMu.Unlock()
 		a.desiredMu.Lock()
 		delete(a.desired, vni)
+		delete(a.remoteMACs, vni)
+		delete(a.staleDesired, vni)
+		delete(a.staleMACs, vni)
 		a.desiredMu.Unlock()
 		slog.Info("unregistered vxlan vni", "vni", vni, "dev", dev)
+		// The worker finds the VNI unregistered and withdraws its
+		// membership and MAC routes.
+		a.queue.add(vni)
 	}
 }
 
-func (a *Agent) resyncRIB(ctx context.Context) map[uint32]struct{} {
+// resyncRIB rebuilds the remote state from a full RIB snapshot and returns
+// the VNIs present in it. The previous state is kept when the snapshot
+// cannot be read completely, so a failed listing never flushes the FDB.
+func (a *Agent) resyncRIB(ctx context.Context) (map[uint32]struct{}, error) {
 	touched := make(map[uint32]struct{})
-	// Pull a full snapshot when VNIs appear to avoid missing FDB entries.
 	ctx, cancel := context.WithTimeout(ctx, a.cfg.GoBGP.Timeout)
 	defer cancel()
-	stream, err := a.client.ListPath(ctx, &api.ListPathRequest{
+	a.desiredMu.Lock()
+	defer a.desiredMu.Unlock()
+	prevDesired, prevMACs, prevPrefixes, prevRefs := a.desired, a.remoteMACs, a.remotePrefixes, a.refs
+	a.desired = make(map[uint32]map[string]remoteVTEP)
+	a.remoteMACs = make(map[uint32]map[string]remoteMAC)
+	a.remotePrefixes = make(map[uint32]map[string]remotePrefix)
+	a.refs = newPathRefs()
+	for _, family := range a.families() {
+		if err := a.listFamily(ctx, family, touched); err != nil {
+			a.desired, a.remoteMACs, a.remotePrefixes, a.refs = prevDesired, prevMACs, prevPrefixes, prevRefs
+			return nil, err
+		}
+	}
+	return touched, nil
+}
+
+// listFamily feeds every path of one family into the desired state. Caller
+// must hold desiredMu.
+func (a *Agent) listFamily(ctx context.Context, family *api.Family, touched map[uint32]struct{}) error {
+	stream, err := a.gobgp().ListPath(ctx, &api.ListPathRequest{
 		TableType: api.TableType_GLOBAL,
-		Family:    &api.Family{Afi: api.Family_AFI_IP, Safi: api.Family_SAFI_UNICAST},
+		Family:    family,
 	})
 	if err != nil {
-		slog.Warn("list path failed", "err", err)
-		return touched
+		return fmt.Errorf("list path %s: %w", family, err)
 	}
-	a.desiredMu.Lock()
-	a.desired = make(map[uint32]map[string]struct{})
 	for {
 		resp, err := stream.Recv()
 		if err == io.EOF {
-			break
+			return nil
 		}
 		if err != nil {
-			slog.Warn("list path recv failed", "err", err)
-			break
+			return fmt.Errorf("list path %s recv: %w", family, err)
 		}
 		dest := resp.GetDestination()
 		if dest == nil || len(dest.Paths) == 0 {
 			continue
 		}
-		for vni := range a.consumePaths(dest.Paths, a.desired) {
+		paths := dest.Paths
+		if a.cfg.MembershipPaths == config.MembershipBest {
+			paths = bestPaths(paths)
+		}
+		for vni := range a.consumePaths(paths) {
 			touched[vni] = struct{}{}
 		}
 	}
-	a.desiredMu.Unlock()
-	return touched
+}
+
+// bestPaths returns the path ListPath marks as best, matching what the
+// BEST watch filter delivers.
+func bestPaths(paths []*api.Path) []*api.Path {
+	for _, p := range paths {
+		if p.Best {
+			return []*api.Path{p}
+		}
+	}
+	return nil
+}
+
+// families lists the address families carrying membership routes. Both
+// unicast families are read in community mode so IPv4 and IPv6 VTEPs can
+// coexist in one fabric, and EVPN for per-VNI membership routes.
+func (a *Agent) families() []*api.Family {
+	if a.cfg.Mode == config.ModeEVPN {
+		return []*api.Family{evpnFamily}
+	}
+	return []*api.Family{
+		{Afi: api.Family_AFI_IP, Safi: api.Family_SAFI_UNICAST},
+		{Afi: api.Family_AFI_IP6, Safi: api.Family_SAFI_UNICAST},
+		evpnFamily,
+	}
 }
 
 func (a *Agent) getOnline(vni uint32) (bool, bool) {
@@ -468,111 +996,310 @@ func (a *Agent) getOnline(vni uint32) (bool, bool) {
 	return val, ok
 }
 
-func (a *Agent) setOnline(vni uint32, online bool) {
+// swapOnline records the online state of the VNI and returns the previous
+// one, so that exactly one caller acts on each transition.
+func (a *Agent) swapOnline(vni uint32, online bool) bool {
 	a.mu.Lock()
+	defer a.mu.Unlock()
+	prev := a.vniOnline[vni]
 	a.vniOnline[vni] = online
-	a.mu.Unlock()
+	return prev
 }
 
-func (a *Agent) snapshotDesired(vni uint32) map[string]struct{} {
+func (a *Agent) snapshotDesired(vni uint32) map[string]remoteVTEP {
 	a.desiredMu.Lock()
 	defer a.desiredMu.Unlock()
-	src := a.desired[vni]
-	if len(src) == 0 {
+	src, stale := a.desired[vni], a.staleDesired[vni]
+	if len(src) == 0 && len(stale) == 0 {
 		return nil
 	}
-	dst := make(map[string]struct{}, len(src))
-	for k := range src {
-		dst[k] = struct{}{}
+	dst := make(map[string]remoteVTEP, len(src)+len(stale))
+	for k, r := range stale {
+		dst[k] = r
+	}
+	for k, r := range src {
+		dst[k] = r
+	}
+	for k := range dst {
+		if a.damp.suppressed(dampKey{vni: vni, vtep: k}) {
+			delete(dst, k)
+		}
 	}
 	return dst
 }
 
-func extractCommunities(p *api.Path) ([]uint32, error) {
+// extractCommunities returns the path's membership communities in the
+// configured encoding, in canonical string form.
+func extractCommunities(p *api.Path, encoding string) ([]string, error) {
 	attrs, err := apiutil.GetNativePathAttributes(p)
 	if err != nil {
 		return nil, err
 	}
-	var res []uint32
+	var res []string
 	for _, attr := range attrs {
-		if comm, ok := attr.(*apibgp.PathAttributeCommunities); ok {
-			res = append(res, comm.Value...)
+		switch a := attr.(type) {
+		case *apibgp.PathAttributeCommunities:
+			if encoding != config.EncodingStandard {
+				continue
+			}
+			for _, v := range a.Value {
+				res = append(res, fmt.Sprintf("%d:%d", v>>16, v&0xffff))
+			}
+		case *apibgp.PathAttributeLargeCommunities:
+			if encoding != config.EncodingLarge {
+				continue
+			}
+			for _, v := range a.Values {
+				res = append(res, v.String())
+			}
+		case *apibgp.PathAttributeExtendedCommunities:
+			if encoding == config.EncodingExtended {
+				res = append(res, routeTargets(a.Value)...)
+			}
 		}
 	}
 	return res, nil
 }
 
-func newCommunityPath(prefix string, communities []uint32) (*api.Path, error) {
-	nlri := apibgp.NewIPAddrPrefix(32, prefix)
-	attrs := []apibgp.PathAttributeInterface{
-		apibgp.NewPathAttributeOrigin(0),
-		apibgp.NewPathAttributeNextHop(prefix),
+// newCommunityPath builds the host route membership path (/32 or /128) for
+// prefix carrying the communities in the configured encoding. The next hop
+// is vtep; encap, when set, is attached as the Tunnel Encapsulation
+// attribute.
+func newCommunityPath(prefix, vtep net.IP, encap apibgp.PathAttributeInterface, encoding string, communities []string) (*api.Path, error) {
+	var nlri apibgp.AddrPrefixInterface
+	attrs := []apibgp.PathAttributeInterface{apibgp.NewPathAttributeOrigin(0)}
+	if prefix.To4() != nil {
+		nlri = apibgp.NewIPAddrPrefix(32, prefix.String())
+		attrs = append(attrs, apibgp.NewPathAttributeNextHop(vtep.String()))
+	} else {
+		nlri = apibgp.NewIPv6AddrPrefix(128, prefix.String())
+		attrs = append(attrs, apibgp.NewPathAttributeMpReachNLRI(vtep.String(), []apibgp.AddrPrefixInterface{nlri}))
 	}
 	if len(communities) > 0 {
-		attrs = append(attrs, apibgp.NewPathAttributeCommunities(communities))
+		attr, err := membershipAttribute(encoding, communities)
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, attr)
+	}
+	if encap != nil {
+		attrs = append(attrs, encap)
 	}
 	return apiutil.NewPath(nlri, false, attrs, time.Now())
 }
 
+func hostPrefix(ip net.IP) string {
+	if ip.To4() != nil {
+		return ip.String() + "/32"
+	}
+	return ip.String() + "/128"
+}
+
+func membershipAttribute(encoding string, communities []string) (apibgp.PathAttributeInterface, error) {
+	switch encoding {
+	case config.EncodingLarge:
+		values := make([]*apibgp.LargeCommunity, 0, len(communities))
+		for _, c := range communities {
+			lc, err := apibgp.ParseLargeCommunity(c)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, lc)
+		}
+		return apibgp.NewPathAttributeLargeCommunities(values), nil
+	case config.EncodingExtended:
+		values := make([]apibgp.ExtendedCommunityInterface, 0, len(communities))
+		for _, c := range communities {
+			rt, err := config.ParseRouteTarget(c)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, rt)
+		}
+		return apibgp.NewPathAttributeExtendedCommunities(values), nil
+	default:
+		values := make([]uint32, 0, len(communities))
+		for _, c := range communities {
+			v, err := config.ParseCommunity(c)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		return apibgp.NewPathAttributeCommunities(values), nil
+	}
+}
+
+// updateLocalPath brings the local membership announcement in line with the
+// online VNIs. A failure schedules a retry with backoff.
 func (a *Agent) updateLocalPath(ctx context.Context) error {
-	// Publish a single local /32 path carrying all active VNI communities.
-	comms := a.collectLocalCommunities()
+	var err error
+	if a.cfg.Mode == config.ModeEVPN || a.cfg.MembershipAdvertisement == config.AdvertisePerVNI {
+		err = a.updateLocalIMET(ctx)
+	} else {
+		err = a.updateLocalCommunityPath(ctx)
+	}
 	a.localPathMu.Lock()
-	if equalComms(a.localComms, comms) {
-		a.localPathMu.Unlock()
-		return nil
+	if err != nil {
+		delay := a.localRetry.next()
+		a.localRetryAt = time.Now().Add(delay)
+		slog.Debug("local membership retry scheduled", "in", delay)
+	} else {
+		a.localRetry.reset()
+		a.localRetryAt = time.Time{}
 	}
-	oldPath := a.localPath
-	a.localComms = append([]uint32(nil), comms...)
 	a.localPathMu.Unlock()
+	return err
+}
 
-	if oldPath != nil {
-		_, _ = a.client.DeletePath(ctx, &api.DeletePathRequest{
-			TableType: api.TableType_GLOBAL,
-			Path:      oldPath,
-		})
+// retryLocalPath re-runs a failed updateLocalPath once its backoff expired.
+func (a *Agent) retryLocalPath(ctx context.Context) {
+	a.localPathMu.Lock()
+	due := !a.localRetryAt.IsZero() && !time.Now().Before(a.localRetryAt)
+	a.localPathMu.Unlock()
+	if !due {
+		return
+	}
+	if err := a.updateLocalPath(ctx); err != nil {
+		slog.Warn("advertise membership failed", "err", err)
+	}
+}
+
+// updateLocalCommunityPath publishes a single local host route carrying all
+// active VNI communities. The new path is added before anything is removed:
+// it shares the NLRI of the old one and replaces it implicitly, so VNIs that
+// did not change never see the node withdrawn. localPathMu is held from
+// reading the online VNIs to recording the result, so concurrent updates
+// cannot announce an older set over a newer one.
+func (a *Agent) updateLocalCommunityPath(ctx context.Context) error {
+	a.localPathMu.Lock()
+	defer a.localPathMu.Unlock()
+	comms := a.collectLocalCommunities()
+	if equalComms(a.localComms, comms) {
+		return nil
 	}
+	oldPath := a.localPath
 
 	if len(comms) == 0 {
-		a.localPathMu.Lock()
+		if oldPath != nil {
+			if _, err := a.gobgp().DeletePath(ctx, &api.DeletePathRequest{
+				TableType: api.TableType_GLOBAL,
+				Path:      oldPath,
+			}); err != nil {
+				return fmt.Errorf("withdraw local membership: %w", err)
+			}
+			slog.Info("withdrew membership", "prefix", hostPrefix(a.membershipPrefix()))
+		}
 		a.localPath = nil
-		a.localPathMu.Unlock()
+		a.localComms = nil
 		return nil
 	}
 
-	path, err := newCommunityPath(a.localIP.String(), comms)
+	prefix := a.membershipPrefix()
+	path, err := newCommunityPath(prefix, a.localIP, a.localTunnelEncap(), a.cfg.CommunityEncoding, comms)
 	if err != nil {
 		return err
 	}
-	if _, err := a.client.AddPath(ctx, &api.AddPathRequest{TableType: api.TableType_GLOBAL, Path: path}); err != nil {
+	if _, err := a.gobgp().AddPath(ctx, &api.AddPathRequest{TableType: api.TableType_GLOBAL, Path: path}); err != nil {
+		// The old path, if any, is still announced and recorded, so the
+		// retry adds the path again.
 		return fmt.Errorf("add path for local membership: %w", err)
 	}
-	a.localPathMu.Lock()
 	a.localPath = path
-	a.localPathMu.Unlock()
-	slog.Info("advertised membership", "prefix", a.localIP.String()+"/32", "communities", comms)
+	a.localComms = comms
+	if oldPath != nil && !proto.Equal(oldPath.Nlri, path.Nlri) {
+		_, _ = a.gobgp().DeletePath(ctx, &api.DeletePathRequest{
+			TableType: api.TableType_GLOBAL,
+			Path:      oldPath,
+		})
+	}
+	slog.Info("advertised membership", "prefix", hostPrefix(prefix), "vtep", a.localIP, "communities", comms)
+	return nil
+}
+
+// updateLocalIMET announces one Type-3 route per online VNI and withdraws
+// routes for VNIs that went offline. In community mode the routes carry the
+// VNI's membership community. Like updateLocalCommunityPath it holds
+// localPathMu from reading the online VNIs to recording the result.
+func (a *Agent) updateLocalIMET(ctx context.Context) error {
+	a.localPathMu.Lock()
+	defer a.localPathMu.Unlock()
+	online := make(map[uint32]config.VNIConfig)
+	a.mapMu.Lock()
+	a.mu.Lock()
+	for vni, up := range a.vniOnline {
+		if cfg, ok := a.idToVNI[vni]; ok && up && !a.damp.suppressed(dampKey{vni: vni}) {
+			online[vni] = cfg
+		}
+	}
+	a.mu.Unlock()
+	a.mapMu.Unlock()
+
+	for vni, path := range a.localIMET {
+		if _, ok := online[vni]; ok {
+			continue
+		}
+		if _, err := a.gobgp().DeletePath(ctx, &api.DeletePathRequest{
+			TableType: api.TableType_GLOBAL,
+			Path:      path,
+		}); err != nil {
+			return fmt.Errorf("delete imet route for vni %d: %w", vni, err)
+		}
+		delete(a.localIMET, vni)
+		slog.Info("withdrew imet route", "vni", vni)
+	}
+	for vni, cfg := range online {
+		if _, ok := a.localIMET[vni]; ok {
+			continue
+		}
+		var path *api.Path
+		var err error
+		if a.cfg.Mode == config.ModeEVPN {
+			path, err = newIMETPath(cfg, a.localIP, a.routerID, a.localTunnelEncap())
+		} else {
+			var comm string
+			comm, err = config.ParseMembership(a.cfg.CommunityEncoding, cfg.Community)
+			if err == nil {
+				path, err = newVNIMembershipPath(cfg, a.localIP, a.routerID, a.localTunnelEncap(), a.cfg.CommunityEncoding, comm)
+			}
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := a.gobgp().AddPath(ctx, &api.AddPathRequest{TableType: api.TableType_GLOBAL, Path: path}); err != nil {
+			return fmt.Errorf("add imet route for vni %d: %w", vni, err)
+		}
+		a.localIMET[vni] = path
+		if a.cfg.Mode == config.ModeEVPN {
+			slog.Info("advertised imet route", "vni", vni, "vtep", a.localIP.String(), "rt", cfg.RouteTarget)
+		} else {
+			slog.Info("advertised vni membership", "vni", vni, "vtep", a.localIP.String(), "community", cfg.Community)
+		}
+	}
 	return nil
 }
 
-func (a *Agent) collectLocalCommunities() []uint32 {
+func (a *Agent) collectLocalCommunities() []string {
 	a.mapMu.Lock()
 	defer a.mapMu.Unlock()
-	var comms []uint32
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var comms []string
 	for vni, online := range a.vniOnline {
-		if !online {
+		if !online || a.damp.suppressed(dampKey{vni: vni}) {
 			continue
 		}
 		if cfg, ok := a.idToVNI[vni]; ok {
-			if comm, err := config.ParseCommunity(cfg.Community); err == nil {
+			if comm, err := config.ParseMembership(a.cfg.CommunityEncoding, cfg.Community); err == nil {
 				comms = append(comms, comm)
 			}
 		}
 	}
-	sort.Slice(comms, func(i, j int) bool { return comms[i] < comms[j] })
+	sort.Strings(comms)
 	return comms
 }
 
-func equalComms(a, b []uint32) bool {
+func equalComms(a, b []string) bool {
 	if len(a) != len(b) {
 		return false
 	}
@@ -0,0 +1,175 @@
+package agent
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"gobgp-evpn-agent/internal/config"
+)
+
+// dampKey identifies a dampened membership: a remote VTEP in a VNI, or the
+// local advertisement of a VNI when vtep is empty.
+type dampKey struct {
+	vni  uint32
+	vtep string
+}
+
+type dampState struct {
+	penalty    float64
+	updated    time.Time
+	suppressed bool
+	since      time.Time
+}
+
+// damper applies RFC 2439 style flap dampening to VNI memberships.
+type damper struct {
+	cfg     config.Dampening
+	ceiling float64
+	now     func() time.Time
+
+	mu      sync.Mutex
+	entries map[dampKey]*dampState
+}
+
+// newDamper returns nil when dampening is disabled; a nil damper never
+// suppresses.
+func newDamper(cfg config.Dampening) *damper {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &damper{
+		cfg:     cfg,
+		ceiling: cfg.ReuseThreshold * math.Exp2(float64(cfg.MaxSuppressTime)/float64(cfg.HalfLife)),
+		now:     time.Now,
+		entries: make(map[dampKey]*dampState),
+	}
+}
+
+// decay brings the penalty of st forward to now.
+func (d *damper) decay(st *dampState, now time.Time) {
+	st.penalty *= math.Exp2(-float64(now.Sub(st.updated)) / float64(d.cfg.HalfLife))
+	st.updated = now
+}
+
+// flap charges a withdrawal of k.
+func (d *damper) flap(k dampKey) {
+	if d == nil {
+		return
+	}
+	now := d.now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	st := d.entries[k]
+	if st == nil {
+		st = &dampState{updated: now}
+		d.entries[k] = st
+	}
+	d.decay(st, now)
+	st.penalty = math.Min(st.penalty+d.cfg.Penalty, d.ceiling)
+	if !st.suppressed && st.penalty >= d.cfg.SuppressThreshold {
+		st.suppressed = true
+		st.since = now
+		slog.Warn("dampening suppressed flapping membership", dampArgs(k, st.penalty)...)
+	}
+}
+
+// suppressed reports whether k is held back. Suppression is lifted only by
+// release so that the caller acting on a release sees it.
+func (d *damper) suppressed(k dampKey) bool {
+	if d == nil {
+		return false
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	st := d.entries[k]
+	return st != nil && st.suppressed
+}
+
+// release lifts suppression of entries whose penalty decayed below the
+// reuse threshold, forgets entries whose penalty is negligible, and returns
+// the released keys.
+func (d *damper) release() []dampKey {
+	if d == nil {
+		return nil
+	}
+	now := d.now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var released []dampKey
+	for k, st := range d.entries {
+		d.decay(st, now)
+		if st.suppressed && st.penalty < d.cfg.ReuseThreshold {
+			st.suppressed = false
+			released = append(released, k)
+			slog.Info("dampening released membership", append(dampArgs(k, st.penalty), "suppressedFor", now.Sub(st.since).Round(time.Second))...)
+		}
+		if !st.suppressed && st.penalty < d.cfg.ReuseThreshold/2 {
+			delete(d.entries, k)
+		}
+	}
+	return released
+}
+
+// Dampened describes a membership whose penalty is being tracked.
+type Dampened struct {
+	VNI uint32 `json:"vni"`
+	// VTEP is the remote VTEP; empty for the local advertisement.
+	VTEP       string    `json:"vtep,omitempty"`
+	Penalty    int       `json:"penalty"`
+	Suppressed bool      `json:"suppressed"`
+	Since      time.Time `json:"since,omitempty"`
+}
+
+func (d *damper) snapshot() []Dampened {
+	if d == nil {
+		return nil
+	}
+	now := d.now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	res := make([]Dampened, 0, len(d.entries))
+	for k, st := range d.entries {
+		d.decay(st, now)
+		e := Dampened{VNI: k.vni, VTEP: k.vtep, Penalty: int(st.penalty), Suppressed: st.suppressed}
+		if st.suppressed {
+			e.Since = st.since
+		}
+		res = append(res, e)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].VNI != res[j].VNI {
+			return res[i].VNI < res[j].VNI
+		}
+		return res[i].VTEP < res[j].VTEP
+	})
+	return res
+}
+
+func dampArgs(k dampKey, penalty float64) []any {
+	if k.vtep == "" {
+		return []any{"vni", k.vni, "local", true, "penalty", int(penalty)}
+	}
+	return []any{"vni", k.vni, "vtep", k.vtep, "penalty", int(penalty)}
+}
+
+// releaseDampened re-advertises local VNIs whose suppression was lifted
+// and queues the VNIs of released remote VTEPs for programming.
+func (a *Agent) releaseDampened(ctx context.Context) {
+	local := false
+	for _, k := range a.damp.release() {
+		if k.vtep == "" {
+			local = true
+			continue
+		}
+		a.queue.add(k.vni)
+	}
+	if local {
+		if err := a.updateLocalPath(ctx); err != nil {
+			slog.Warn("advertise membership failed", "err", err)
+		}
+	}
+}
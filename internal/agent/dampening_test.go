@@ -0,0 +1,124 @@
+package agent
+
+import (
+	"testing"
+	"time"
+
+	"gobgp-evpn-agent/internal/config"
+)
+
+var testDampening = config.Dampening{
+	Enabled:           true,
+	Penalty:           1000,
+	SuppressThreshold: 2000,
+	ReuseThreshold:    750,
+	HalfLife:          time.Minute,
+	MaxSuppressTime:   4 * time.Minute,
+}
+
+// testDamper returns a damper on a clock the test advances.
+func testDamper() (*damper, func(time.Duration)) {
+	d := newDamper(testDampening)
+	now := time.Unix(0, 0)
+	d.now = func() time.Time { return now }
+	return d, func(dt time.Duration) { now = now.Add(dt) }
+}
+
+func TestDamperNil(t *testing.T) {
+	d := newDamper(config.Dampening{})
+	k := dampKey{vni: 100}
+	for i := 0; i < 10; i++ {
+		d.flap(k)
+	}
+	if d.suppressed(k) || d.release() != nil || d.snapshot() != nil {
+		t.Fatal("disabled damper must never suppress")
+	}
+}
+
+func TestDamper(t *testing.T) {
+	k := dampKey{vni: 100, vtep: "10.0.0.9"}
+	type step struct {
+		advance    time.Duration
+		flaps      int
+		suppressed bool
+		released   bool
+		penalty    int // -1 when the entry is forgotten
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "one flap stays below threshold",
+			steps: []step{
+				{flaps: 1, penalty: 1000},
+			},
+		},
+		{
+			name: "two quick flaps suppress",
+			steps: []step{
+				{flaps: 2, suppressed: true, penalty: 2000},
+			},
+		},
+		{
+			name: "penalty halves every half-life",
+			steps: []step{
+				{flaps: 1, penalty: 1000},
+				{advance: time.Minute, penalty: 500},
+				// Below half the reuse threshold the entry is forgotten.
+				{advance: time.Minute, penalty: -1},
+			},
+		},
+		{
+			name: "decay before the second flap avoids suppression",
+			steps: []step{
+				{flaps: 1},
+				{advance: time.Minute, flaps: 1, penalty: 1500},
+			},
+		},
+		{
+			name: "released once below reuse threshold",
+			steps: []step{
+				{flaps: 2, suppressed: true},
+				{advance: time.Minute, suppressed: true, penalty: 1000},
+				{advance: time.Minute, released: true, penalty: 500},
+			},
+		},
+		{
+			name: "max suppress time bounds suppression",
+			steps: []step{
+				{flaps: 50, suppressed: true, penalty: 12000},
+				{advance: 4*time.Minute - time.Second, suppressed: true},
+				{advance: 2 * time.Second, released: true},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, advance := testDamper()
+			for i, s := range tt.steps {
+				advance(s.advance)
+				for j := 0; j < s.flaps; j++ {
+					d.flap(k)
+				}
+				released := d.release()
+				if got := len(released) == 1 && released[0] == k; got != s.released {
+					t.Fatalf("step %d: released %v, want %v", i, released, s.released)
+				}
+				if got := d.suppressed(k); got != s.suppressed {
+					t.Fatalf("step %d: suppressed %v, want %v", i, got, s.suppressed)
+				}
+				if s.penalty == 0 {
+					continue
+				}
+				snap := d.snapshot()
+				switch {
+				case s.penalty == -1 && len(snap) != 0:
+					t.Fatalf("step %d: entry kept: %+v", i, snap)
+				case s.penalty > 0 && (len(snap) != 1 || snap[0].Penalty != s.penalty):
+					t.Fatalf("step %d: snapshot %+v, want penalty %d", i, snap, s.penalty)
+				}
+			}
+		})
+	}
+}
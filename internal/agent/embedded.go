@@ -0,0 +1,243 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+
+	api "github.com/osrg/gobgp/v3/api"
+	gobgplog "github.com/osrg/gobgp/v3/pkg/log"
+	"github.com/osrg/gobgp/v3/pkg/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// embeddedAddress is reported as the endpoint when bgp.enabled is set.
+const embeddedAddress = "embedded"
+
+// startEmbedded starts the in-process GoBGP speaker described by the bgp
+// section and returns it as the agent's only endpoint.
+func (a *Agent) startEmbedded(ctx context.Context) (*endpoint, error) {
+	b := a.bgpConfig()
+	s := server.NewBgpServer(server.LoggerOption(bgpLogger{}))
+	go s.Serve()
+	c := &embeddedClient{s: s}
+	if err := a.reconcileBGP(ctx, c, b); err != nil {
+		s.Stop()
+		return nil, fmt.Errorf("start embedded bgp: %w", err)
+	}
+	slog.Info("embedded bgp speaker started", "asn", b.ASN, "port", b.ListenPort,
+		"neighbors", len(b.Neighbors), "dynamicNeighbors", len(b.DynamicNeighbors))
+	return &endpoint{address: embeddedAddress, client: c, server: s}, nil
+}
+
+// embeddedClient serves the GobgpApiClient calls the agent makes from an
+// in-process BgpServer. Calls it does not implement panic through the nil
+// embedded interface.
+type embeddedClient struct {
+	api.GobgpApiClient
+	s *server.BgpServer
+}
+
+func (c *embeddedClient) AddPath(ctx context.Context, in *api.AddPathRequest, _ ...grpc.CallOption) (*api.AddPathResponse, error) {
+	return c.s.AddPath(ctx, in)
+}
+
+func (c *embeddedClient) DeletePath(ctx context.Context, in *api.DeletePathRequest, _ ...grpc.CallOption) (*emptypb.Empty, error) {
+	return &emptypb.Empty{}, c.s.DeletePath(ctx, in)
+}
+
+func (c *embeddedClient) GetBgp(ctx context.Context, in *api.GetBgpRequest, _ ...grpc.CallOption) (*api.GetBgpResponse, error) {
+	return c.s.GetBgp(ctx, in)
+}
+
+func (c *embeddedClient) GetTable(ctx context.Context, in *api.GetTableRequest, _ ...grpc.CallOption) (*api.GetTableResponse, error) {
+	return c.s.GetTable(ctx, in)
+}
+
+func (c *embeddedClient) ListPath(ctx context.Context, in *api.ListPathRequest, _ ...grpc.CallOption) (api.GobgpApi_ListPathClient, error) {
+	st := &sliceStream[*api.ListPathResponse]{localStream: localStream{ctx: ctx}}
+	err := c.s.ListPath(ctx, in, func(d *api.Destination) {
+		st.items = append(st.items, &api.ListPathResponse{Destination: d})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func (c *embeddedClient) StartBgp(ctx context.Context, in *api.StartBgpRequest, _ ...grpc.CallOption) (*emptypb.Empty, error) {
+	return &emptypb.Empty{}, c.s.StartBgp(ctx, in)
+}
+
+func (c *embeddedClient) AddPeer(ctx context.Context, in *api.AddPeerRequest, _ ...grpc.CallOption) (*emptypb.Empty, error) {
+	return &emptypb.Empty{}, c.s.AddPeer(ctx, in)
+}
+
+func (c *embeddedClient) DeletePeer(ctx context.Context, in *api.DeletePeerRequest, _ ...grpc.CallOption) (*emptypb.Empty, error) {
+	return &emptypb.Empty{}, c.s.DeletePeer(ctx, in)
+}
+
+func (c *embeddedClient) ListPeer(ctx context.Context, in *api.ListPeerRequest, _ ...grpc.CallOption) (api.GobgpApi_ListPeerClient, error) {
+	st := &sliceStream[*api.ListPeerResponse]{localStream: localStream{ctx: ctx}}
+	err := c.s.ListPeer(ctx, in, func(p *api.Peer) {
+		st.items = append(st.items, &api.ListPeerResponse{Peer: p})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func (c *embeddedClient) AddPeerGroup(ctx context.Context, in *api.AddPeerGroupRequest, _ ...grpc.CallOption) (*emptypb.Empty, error) {
+	return &emptypb.Empty{}, c.s.AddPeerGroup(ctx, in)
+}
+
+func (c *embeddedClient) UpdatePeerGroup(ctx context.Context, in *api.UpdatePeerGroupRequest, _ ...grpc.CallOption) (*api.UpdatePeerGroupResponse, error) {
+	return c.s.UpdatePeerGroup(ctx, in)
+}
+
+func (c *embeddedClient) DeletePeerGroup(ctx context.Context, in *api.DeletePeerGroupRequest, _ ...grpc.CallOption) (*emptypb.Empty, error) {
+	return &emptypb.Empty{}, c.s.DeletePeerGroup(ctx, in)
+}
+
+func (c *embeddedClient) ListPeerGroup(ctx context.Context, in *api.ListPeerGroupRequest, _ ...grpc.CallOption) (api.GobgpApi_ListPeerGroupClient, error) {
+	st := &sliceStream[*api.ListPeerGroupResponse]{localStream: localStream{ctx: ctx}}
+	err := c.s.ListPeerGroup(ctx, in, func(g *api.PeerGroup) {
+		st.items = append(st.items, &api.ListPeerGroupResponse{PeerGroup: g})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func (c *embeddedClient) AddDynamicNeighbor(ctx context.Context, in *api.AddDynamicNeighborRequest, _ ...grpc.CallOption) (*emptypb.Empty, error) {
+	return &emptypb.Empty{}, c.s.AddDynamicNeighbor(ctx, in)
+}
+
+func (c *embeddedClient) DeleteDynamicNeighbor(ctx context.Context, in *api.DeleteDynamicNeighborRequest, _ ...grpc.CallOption) (*emptypb.Empty, error) {
+	return &emptypb.Empty{}, c.s.DeleteDynamicNeighbor(ctx, in)
+}
+
+func (c *embeddedClient) ListDynamicNeighbor(ctx context.Context, in *api.ListDynamicNeighborRequest, _ ...grpc.CallOption) (api.GobgpApi_ListDynamicNeighborClient, error) {
+	st := &sliceStream[*api.ListDynamicNeighborResponse]{localStream: localStream{ctx: ctx}}
+	err := c.s.ListDynamicNeighbor(ctx, in, func(d *api.DynamicNeighbor) {
+		st.items = append(st.items, &api.ListDynamicNeighborResponse{DynamicNeighbor: d})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func (c *embeddedClient) WatchEvent(ctx context.Context, in *api.WatchEventRequest, _ ...grpc.CallOption) (api.GobgpApi_WatchEventClient, error) {
+	st := &watchEventStream{localStream: localStream{ctx: ctx}, ch: make(chan *api.WatchEventResponse)}
+	err := c.s.WatchEvent(ctx, in, func(r *api.WatchEventResponse) {
+		select {
+		case st.ch <- r:
+		case <-ctx.Done():
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// localStream implements grpc.ClientStream for in-process results.
+type localStream struct {
+	ctx context.Context
+}
+
+func (s *localStream) Header() (metadata.MD, error) { return nil, nil }
+func (s *localStream) Trailer() metadata.MD         { return nil }
+func (s *localStream) CloseSend() error             { return nil }
+func (s *localStream) Context() context.Context     { return s.ctx }
+func (s *localStream) SendMsg(any) error            { return nil }
+func (s *localStream) RecvMsg(any) error            { return io.EOF }
+
+// sliceStream replays results collected from a server-side list call.
+type sliceStream[T any] struct {
+	localStream
+	items []T
+}
+
+func (s *sliceStream[T]) Recv() (T, error) {
+	if len(s.items) == 0 {
+		var zero T
+		return zero, io.EOF
+	}
+	r := s.items[0]
+	s.items = s.items[1:]
+	return r, nil
+}
+
+type watchEventStream struct {
+	localStream
+	ch chan *api.WatchEventResponse
+}
+
+func (s *watchEventStream) Recv() (*api.WatchEventResponse, error) {
+	select {
+	case r := <-s.ch:
+		return r, nil
+	case <-s.ctx.Done():
+		return nil, s.ctx.Err()
+	}
+}
+
+// bgpLogger routes GoBGP's log output through slog. The level is governed
+// by the agent's logLevel.
+type bgpLogger struct{}
+
+func (bgpLogger) Panic(msg string, fields gobgplog.Fields) {
+	slog.Error(msg, fieldArgs(fields)...)
+	panic(msg)
+}
+
+func (bgpLogger) Fatal(msg string, fields gobgplog.Fields) {
+	slog.Error(msg, fieldArgs(fields)...)
+	panic(msg)
+}
+
+func (bgpLogger) Error(msg string, fields gobgplog.Fields) { slog.Error(msg, fieldArgs(fields)...) }
+func (bgpLogger) Warn(msg string, fields gobgplog.Fields)  { slog.Warn(msg, fieldArgs(fields)...) }
+func (bgpLogger) Info(msg string, fields gobgplog.Fields)  { slog.Info(msg, fieldArgs(fields)...) }
+func (bgpLogger) Debug(msg string, fields gobgplog.Fields) { slog.Debug(msg, fieldArgs(fields)...) }
+func (bgpLogger) SetLevel(gobgplog.LogLevel)               {}
+
+// GetLevel maps the level slog currently logs at, which a config reload may
+// change, so GoBGP skips building records that would be dropped.
+func (bgpLogger) GetLevel() gobgplog.LogLevel {
+	h := slog.Default().Handler()
+	ctx := context.Background()
+	switch {
+	case h.Enabled(ctx, slog.LevelDebug):
+		return gobgplog.DebugLevel
+	case h.Enabled(ctx, slog.LevelInfo):
+		return gobgplog.InfoLevel
+	case h.Enabled(ctx, slog.LevelWarn):
+		return gobgplog.WarnLevel
+	default:
+		return gobgplog.ErrorLevel
+	}
+}
+
+func fieldArgs(fields gobgplog.Fields) []any {
+	args := make([]any, 0, 2*len(fields)+2)
+	args = append(args, "component", "bgp")
+	for k, v := range fields {
+		if k == "Topic" {
+			k = "topic"
+		}
+		if ip, ok := v.(net.IP); ok {
+			v = ip.String()
+		}
+		args = append(args, k, v)
+	}
+	return args
+}
@@ -0,0 +1,262 @@
+package agent
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	api "github.com/osrg/gobgp/v3/api"
+	gobgplog "github.com/osrg/gobgp/v3/pkg/log"
+	"github.com/osrg/gobgp/v3/pkg/server"
+
+	"gobgp-evpn-agent/internal/config"
+)
+
+func TestBGPLoggerLevel(t *testing.T) {
+	prev := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(prev) })
+	tests := []struct {
+		level slog.Level
+		want  gobgplog.LogLevel
+	}{
+		{slog.LevelDebug, gobgplog.DebugLevel},
+		{slog.LevelInfo, gobgplog.InfoLevel},
+		{slog.LevelWarn, gobgplog.WarnLevel},
+		{slog.LevelError, gobgplog.ErrorLevel},
+	}
+	for _, tt := range tests {
+		slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: tt.level})))
+		if got := (bgpLogger{}).GetLevel(); got != tt.want {
+			t.Errorf("slog level %s: GetLevel = %d, want %d", tt.level, got, tt.want)
+		}
+	}
+}
+
+// peerSettings is what the bgp section controls on a neighbor or group.
+type peerSettings struct {
+	ASN     uint32
+	TTL     uint32
+	Cluster string // route reflector cluster id when a client
+}
+
+func settingsOf(asn uint32, mh *api.EbgpMultihop, rr *api.RouteReflector) peerSettings {
+	s := peerSettings{ASN: asn}
+	if mh.GetEnabled() {
+		s.TTL = mh.GetMultihopTtl()
+	}
+	if rr.GetRouteReflectorClient() {
+		s.Cluster = rr.GetRouteReflectorClusterId()
+	}
+	return s
+}
+
+func TestPeerFromConfig(t *testing.T) {
+	group := config.BGPPeerGroup{Name: "spines", PeerASN: 65001, MultihopTTL: 4, RRClient: true}
+	tests := []struct {
+		name     string
+		neighbor config.BGPNeighbor
+		group    config.BGPPeerGroup
+		want     peerSettings
+	}{
+		{
+			name:     "no group",
+			neighbor: config.BGPNeighbor{Address: "192.0.2.1", PeerASN: 65002},
+			want:     peerSettings{ASN: 65002},
+		},
+		{
+			name:     "inherits from group",
+			neighbor: config.BGPNeighbor{Address: "192.0.2.1", PeerGroup: "spines"},
+			group:    group,
+			want:     peerSettings{ASN: 65001, TTL: 4, Cluster: "10.0.0.1"},
+		},
+		{
+			name:     "own settings win",
+			neighbor: config.BGPNeighbor{Address: "192.0.2.1", PeerGroup: "spines", PeerASN: 65002, MultihopTTL: 2},
+			group:    group,
+			want:     peerSettings{ASN: 65002, TTL: 2, Cluster: "10.0.0.1"},
+		},
+		{
+			name:     "route reflector client without group",
+			neighbor: config.BGPNeighbor{Address: "192.0.2.1", PeerASN: 65000, RRClient: true},
+			want:     peerSettings{ASN: 65000, Cluster: "10.0.0.1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, addPath := range []bool{false, true} {
+				p := peerFromConfig(tt.neighbor, tt.group, "10.0.0.1", addPath)
+				if p.Conf.NeighborAddress != tt.neighbor.Address || p.Conf.PeerGroup != "" {
+					t.Fatalf("address %q group %q", p.Conf.NeighborAddress, p.Conf.PeerGroup)
+				}
+				if got := settingsOf(p.Conf.PeerAsn, p.EbgpMultihop, p.RouteReflector); got != tt.want {
+					t.Fatalf("settings %+v, want %+v", got, tt.want)
+				}
+				if len(p.AfiSafis) != 3 {
+					t.Fatalf("%d families, want 3", len(p.AfiSafis))
+				}
+				for _, as := range p.AfiSafis {
+					if got := as.GetAddPaths().GetConfig().GetReceive(); got != addPath {
+						t.Fatalf("family %v add-path receive %v, want %v", as.Config.Family, got, addPath)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestBGPRouterID(t *testing.T) {
+	tests := []struct {
+		name     string
+		routerID string // bgp.routerId
+		nodeID   net.IP // node.routerId, or the local IPv4 address
+		want     string
+		wantErr  bool
+	}{
+		{name: "explicit", routerID: "10.0.0.9", nodeID: net.ParseIP("10.0.0.1"), want: "10.0.0.9"},
+		{name: "node router id", nodeID: net.ParseIP("10.0.0.1"), want: "10.0.0.1"},
+		{name: "explicit on ipv6 underlay", routerID: "10.0.0.9", want: "10.0.0.9"},
+		{name: "ipv6 underlay", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &Agent{routerID: tt.nodeID}
+			got, err := a.bgpRouterID(config.BGPConfig{RouterID: tt.routerID})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("want error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("router id %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestReconcileEmbeddedBGP converges an in-process speaker through a
+// sequence of bgp sections and checks the configuration it ends up with.
+func TestReconcileEmbeddedBGP(t *testing.T) {
+	type state struct {
+		routerID  string
+		groups    map[string]peerSettings
+		neighbors map[string]peerSettings
+		dynamic   map[string]string
+	}
+	spines := config.BGPPeerGroup{Name: "spines", PeerASN: 65001, MultihopTTL: 4, RRClient: true}
+	leaves := config.BGPPeerGroup{Name: "leaves", PeerASN: 65000}
+	steps := []struct {
+		name string
+		bgp  config.BGPConfig
+		want state
+	}{
+		{
+			name: "initial",
+			bgp: config.BGPConfig{
+				PeerGroups: []config.BGPPeerGroup{spines, leaves},
+				Neighbors: []config.BGPNeighbor{
+					{Address: "192.0.2.1", PeerGroup: "spines"},
+					{Address: "192.0.2.2", PeerGroup: "spines", PeerASN: 65002},
+				},
+				DynamicNeighbors: []config.BGPDynamicNeighbor{{Prefix: "198.51.100.0/24", PeerGroup: "leaves"}},
+			},
+			want: state{
+				routerID: "10.0.0.1",
+				groups: map[string]peerSettings{
+					"spines": {ASN: 65001, TTL: 4, Cluster: "10.0.0.1"},
+					"leaves": {ASN: 65000},
+				},
+				neighbors: map[string]peerSettings{
+					"192.0.2.1": {ASN: 65001, TTL: 4, Cluster: "10.0.0.1"},
+					"192.0.2.2": {ASN: 65002, TTL: 4, Cluster: "10.0.0.1"},
+				},
+				dynamic: map[string]string{"198.51.100.0/24": "leaves"},
+			},
+		},
+		{
+			name: "group change reaches inheriting neighbor",
+			bgp: config.BGPConfig{
+				ClusterID:  "10.0.0.100",
+				PeerGroups: []config.BGPPeerGroup{{Name: "spines", PeerASN: 65003}, leaves},
+				Neighbors: []config.BGPNeighbor{
+					{Address: "192.0.2.1", PeerGroup: "spines"},
+				},
+				DynamicNeighbors: []config.BGPDynamicNeighbor{
+					{Prefix: "198.51.100.0/24", PeerGroup: "spines"},
+					{Prefix: "203.0.113.0/24", PeerGroup: "leaves"},
+				},
+			},
+			want: state{
+				routerID: "10.0.0.1",
+				groups: map[string]peerSettings{
+					"spines": {ASN: 65003},
+					"leaves": {ASN: 65000},
+				},
+				neighbors: map[string]peerSettings{
+					"192.0.2.1": {ASN: 65003},
+				},
+				dynamic: map[string]string{
+					"198.51.100.0/24": "spines",
+					"203.0.113.0/24":  "leaves",
+				},
+			},
+		},
+		{
+			name: "everything removed",
+			bgp:  config.BGPConfig{},
+			want: state{routerID: "10.0.0.1", groups: map[string]peerSettings{}, neighbors: map[string]peerSettings{}, dynamic: map[string]string{}},
+		},
+	}
+
+	s := server.NewBgpServer(server.LoggerOption(bgpLogger{}))
+	go s.Serve()
+	t.Cleanup(s.Stop)
+	c := &embeddedClient{s: s}
+	var cfg config.Config
+	cfg.GoBGP.Timeout = 5 * time.Second
+	a := &Agent{cfg: cfg, routerID: net.ParseIP("10.0.0.1")}
+	ctx := context.Background()
+	for _, step := range steps {
+		b := step.bgp
+		b.Enabled, b.ASN, b.ListenPort = true, 65000, -1
+		if err := a.reconcileBGP(ctx, c, b); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		global, err := c.GetBgp(ctx, &api.GetBgpRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := state{
+			routerID:  global.Global.RouterId,
+			groups:    make(map[string]peerSettings),
+			neighbors: make(map[string]peerSettings),
+		}
+		groups, err := listPeerGroups(ctx, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, g := range groups {
+			got.groups[name] = settingsOf(g.Conf.PeerAsn, g.EbgpMultihop, g.RouteReflector)
+		}
+		peers, err := listPeers(ctx, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for addr, p := range peers {
+			got.neighbors[addr] = settingsOf(p.Conf.PeerAsn, p.EbgpMultihop, p.RouteReflector)
+		}
+		if got.dynamic, err = listDynamicNeighbors(ctx, c); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, step.want) {
+			t.Fatalf("%s:\n got %+v\nwant %+v", step.name, got, step.want)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	api "github.com/osrg/gobgp/v3/api"
+	"github.com/osrg/gobgp/v3/pkg/server"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/backoff"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+
+	"gobgp-evpn-agent/internal/tlsutil"
+)
+
+// failbackInterval is how often a more preferred endpoint is probed while
+// the agent is attached to a fallback one.
+const failbackInterval = 10 * time.Second
+
+// endpoint is one gobgpd the agent can attach to. Endpoints are ordered by
+// preference; exactly one is active at a time. The embedded speaker is a
+// single endpoint with a server and no conn.
+type endpoint struct {
+	address string
+	conn    *grpc.ClientConn
+	server  *server.BgpServer
+	client  api.GobgpApiClient
+	// lost is set when the channel left READY since the last session on
+	// this endpoint. Guarded by Agent.statusMu.
+	lost bool
+	// orphans are local paths still announced here after a failover whose
+	// withdrawal failed. Guarded by Agent.statusMu.
+	orphans []*api.Path
+}
+
+func (a *Agent) connect() error {
+	if a.cfg.BGP.Enabled {
+		ep, err := a.startEmbedded(context.Background())
+		if err != nil {
+			return err
+		}
+		a.endpoints = []*endpoint{ep}
+		return nil
+	}
+	for _, addr := range a.cfg.GoBGP.Endpoints {
+		creds, err := a.transportCredentials(addr)
+		if err != nil {
+			return err
+		}
+		conn, err := grpc.Dial(
+			addr,
+			grpc.WithTransportCredentials(creds),
+			// Do not block: gobgpd may still be starting or restarting. The
+			// channel redials in the background and Run retries the watch.
+			grpc.WithConnectParams(grpc.ConnectParams{
+				Backoff: backoff.Config{
+					BaseDelay:  reconnectBaseDelay,
+					Multiplier: 1.6,
+					Jitter:     0.2,
+					MaxDelay:   reconnectMaxDelay,
+				},
+				MinConnectTimeout: a.cfg.GoBGP.Timeout,
+			}),
+			grpc.WithKeepaliveParams(keepalive.ClientParameters{
+				Time:                2 * time.Minute,
+				Timeout:             20 * time.Second,
+				PermitWithoutStream: true,
+			}),
+		)
+		if err != nil {
+			return fmt.Errorf("connect gobgp at %s: %w", addr, err)
+		}
+		a.endpoints = append(a.endpoints, &endpoint{address: addr, conn: conn, client: api.NewGobgpApiClient(conn)})
+	}
+	return nil
+}
+
+// transportCredentials returns TLS credentials when gobgp.tls is enabled and
+// plaintext otherwise.
+func (a *Agent) transportCredentials(addr string) (credentials.TransportCredentials, error) {
+	t := a.cfg.GoBGP.TLS
+	if !t.Enabled {
+		return insecure.NewCredentials(), nil
+	}
+	serverName := t.ServerName
+	if serverName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("gobgp address %q: %w", addr, err)
+		}
+		serverName = host
+	}
+	tc, err := tlsutil.ClientConfig(t, serverName)
+	if err != nil {
+		return nil, fmt.Errorf("gobgp tls: %w", err)
+	}
+	return credentials.NewTLS(tc), nil
+}
+
+// gobgp returns the client of the active endpoint.
+func (a *Agent) gobgp() api.GobgpApiClient {
+	a.statusMu.Lock()
+	defer a.statusMu.Unlock()
+	return a.endpoints[a.active].client
+}
+
+// healthy probes an endpoint with a cheap unary call.
+func (a *Agent) healthy(ctx context.Context, ep *endpoint) bool {
+	if ep.conn != nil && ep.conn.GetState() == connectivity.TransientFailure {
+		// Do not wait out the channel's redial backoff before probing.
+		ep.conn.ResetConnectBackoff()
+	}
+	ctx, cancel := context.WithTimeout(ctx, a.cfg.GoBGP.Timeout)
+	defer cancel()
+	_, err := ep.client.GetBgp(ctx, &api.GetBgpRequest{}, grpc.WaitForReady(true))
+	return err == nil
+}
+
+// selectEndpoint returns the most preferred healthy endpoint, or the
+// active one when none answers.
+func (a *Agent) selectEndpoint(ctx context.Context) int {
+	a.statusMu.Lock()
+	active := a.active
+	a.statusMu.Unlock()
+	if len(a.endpoints) == 1 {
+		return active
+	}
+	for i, ep := range a.endpoints {
+		if a.healthy(ctx, ep) {
+			return i
+		}
+		slog.Debug("gobgp endpoint unhealthy", "endpoint", ep.address)
+	}
+	return active
+}
+
+// switchEndpoint makes idx the active endpoint. The local routes are
+// withdrawn from the previous endpoint first so the fabric never sees the
+// node through both; the next session re-advertises them on the new one.
+// localPathMu is held from the withdrawal to the switch: every announcement
+// holds it too, so none can reach the previous endpoint in between.
+func (a *Agent) switchEndpoint(ctx context.Context, idx int) {
+	a.failoverMu.Lock()
+	defer a.failoverMu.Unlock()
+	a.statusMu.Lock()
+	prev := a.endpoints[a.active]
+	if idx == a.active {
+		a.statusMu.Unlock()
+		return
+	}
+	a.statusMu.Unlock()
+
+	next := a.endpoints[idx]
+	slog.Warn("failing over gobgp endpoint", "from", prev.address, "to", next.address)
+	a.localPathMu.Lock()
+	defer a.localPathMu.Unlock()
+	orphans := a.withdrawAll(ctx, prev, a.localPaths())
+
+	a.statusMu.Lock()
+	prev.orphans = append(prev.orphans, orphans...)
+	// Whatever was left behind here is re-advertised by the next session.
+	next.orphans = nil
+	a.active = idx
+	a.switched = true
+	a.status.Endpoint = next.address
+	a.statusMu.Unlock()
+}
+
+// localPaths lists every route the agent currently announces. Caller must
+// hold localPathMu.
+func (a *Agent) localPaths() []*api.Path {
+	var res []*api.Path
+	if a.localPath != nil {
+		res = append(res, a.localPath)
+	}
+	for _, p := range a.localIMET {
+		res = append(res, p)
+	}
+	for _, m := range a.localMACs {
+		for _, p := range m {
+			res = append(res, p)
+		}
+	}
+	for _, m := range a.localPrefixes {
+		for _, p := range m {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+// withdrawAll deletes paths from an endpoint and returns those it could
+// not delete. An unreachable endpoint is not retried path by path.
+func (a *Agent) withdrawAll(ctx context.Context, ep *endpoint, paths []*api.Path) []*api.Path {
+	if len(paths) == 0 {
+		return nil
+	}
+	if !a.healthy(ctx, ep) {
+		slog.Warn("previous gobgp endpoint unreachable, withdrawal pending", "endpoint", ep.address, "pending", len(paths))
+		return paths
+	}
+	for i, p := range paths {
+		ctx, cancel := context.WithTimeout(ctx, a.cfg.GoBGP.Timeout)
+		_, err := ep.client.DeletePath(ctx, &api.DeletePathRequest{TableType: api.TableType_GLOBAL, Path: p})
+		cancel()
+		if err != nil {
+			slog.Warn("withdraw from previous gobgp endpoint failed, will retry", "endpoint", ep.address, "pending", len(paths)-i, "err", err)
+			return paths[i:]
+		}
+	}
+	slog.Info("withdrew local routes from previous gobgp endpoint", "endpoint", ep.address, "paths", len(paths))
+	return nil
+}
+
+// preferEndpoints ends the current session when a more preferred endpoint
+// is healthy again, and retries withdrawals left behind by failovers.
+func (a *Agent) preferEndpoints(ctx context.Context) {
+	ticker := time.NewTicker(failbackInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		a.failoverMu.Lock()
+		a.statusMu.Lock()
+		active, cancel := a.active, a.sessionCancel
+		a.statusMu.Unlock()
+		for i, ep := range a.endpoints {
+			if i == active {
+				continue
+			}
+			a.statusMu.Lock()
+			orphans := ep.orphans
+			ep.orphans = nil
+			a.statusMu.Unlock()
+			if len(orphans) > 0 {
+				orphans = a.withdrawAll(ctx, ep, orphans)
+				a.statusMu.Lock()
+				ep.orphans = append(ep.orphans, orphans...)
+				a.statusMu.Unlock()
+			}
+		}
+		a.failoverMu.Unlock()
+		for i := 0; i < active; i++ {
+			if a.healthy(ctx, a.endpoints[i]) {
+				slog.Info("preferred gobgp endpoint healthy again", "endpoint", a.endpoints[i].address)
+				if cancel != nil {
+					cancel()
+				}
+				break
+			}
+		}
+	}
+}
+
+// monitorConn flags transport loss whenever an endpoint's channel leaves
+// READY. A dropped transport means gobgpd may have restarted with an empty
+// RIB.
+func (a *Agent) monitorConn(ctx context.Context, ep *endpoint) {
+	if ep.conn == nil {
+		// The embedded speaker cannot restart underneath the agent.
+		return
+	}
+	state := ep.conn.GetState()
+	for {
+		if state != connectivity.Ready {
+			a.statusMu.Lock()
+			ep.lost = true
+			a.statusMu.Unlock()
+		}
+		if !ep.conn.WaitForStateChange(ctx, state) {
+			return
+		}
+		state = ep.conn.GetState()
+		slog.Debug("gobgp channel state", "endpoint", ep.address, "state", state.String())
+	}
+}
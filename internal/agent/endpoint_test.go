@@ -0,0 +1,178 @@
+package agent
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	api "github.com/osrg/gobgp/v3/api"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/emptypb"
+
+	"gobgp-evpn-agent/internal/config"
+)
+
+// fakeGoBGP records the paths announced to one endpoint. When hold is set,
+// the next DeletePath receives from it once after deleting and again before
+// returning, so a test can meet and then hold a withdrawal.
+type fakeGoBGP struct {
+	api.GobgpApiClient
+	mu    sync.Mutex
+	hold  chan struct{}
+	paths map[string]*api.Path
+}
+
+func newFakeGoBGP() *fakeGoBGP {
+	return &fakeGoBGP{paths: make(map[string]*api.Path)}
+}
+
+func (f *fakeGoBGP) GetBgp(context.Context, *api.GetBgpRequest, ...grpc.CallOption) (*api.GetBgpResponse, error) {
+	return &api.GetBgpResponse{}, nil
+}
+
+func (f *fakeGoBGP) AddPath(_ context.Context, in *api.AddPathRequest, _ ...grpc.CallOption) (*api.AddPathResponse, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.paths[in.Path.Nlri.String()] = in.Path
+	return &api.AddPathResponse{}, nil
+}
+
+func (f *fakeGoBGP) DeletePath(_ context.Context, in *api.DeletePathRequest, _ ...grpc.CallOption) (*emptypb.Empty, error) {
+	f.mu.Lock()
+	delete(f.paths, in.Path.Nlri.String())
+	hold := f.hold
+	f.hold = nil
+	f.mu.Unlock()
+	if hold != nil {
+		<-hold
+		<-hold
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (f *fakeGoBGP) announced() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.paths)
+}
+
+func TestSwitchEndpointAnnouncement(t *testing.T) {
+	tests := []struct {
+		name string
+		// change alters the online VNIs while the switch is in progress.
+		change   func(a *Agent)
+		wantNext int
+	}{
+		{
+			name: "vni comes online",
+			change: func(a *Agent) {
+				a.idToVNI[200] = config.VNIConfig{ID: 200, Community: "65000:200"}
+				a.vniOnline[200] = true
+			},
+			wantNext: 1,
+		},
+		{
+			name:     "last vni goes offline",
+			change:   func(a *Agent) { a.vniOnline[100] = false },
+			wantNext: 0,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			prev, next := newFakeGoBGP(), newFakeGoBGP()
+			var cfg config.Config
+			cfg.Mode = config.ModeCommunity
+			cfg.CommunityEncoding = config.EncodingStandard
+			cfg.GoBGP.Timeout = time.Second
+			a := &Agent{
+				cfg:       cfg,
+				localIP:   net.ParseIP("10.0.0.1"),
+				vniOnline: map[uint32]bool{100: true},
+				idToVNI:   map[uint32]config.VNIConfig{100: {ID: 100, Community: "65000:100"}},
+				endpoints: []*endpoint{
+					{address: "prev", client: prev},
+					{address: "next", client: next},
+				},
+			}
+			ctx := context.Background()
+			if err := a.updateLocalPath(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			// Hold the switch right after it withdrew from the previous
+			// endpoint, then let a worker announce meanwhile.
+			hold := make(chan struct{})
+			prev.mu.Lock()
+			prev.hold = hold
+			prev.mu.Unlock()
+			switched := make(chan struct{})
+			go func() {
+				a.switchEndpoint(ctx, 1)
+				close(switched)
+			}()
+			hold <- struct{}{}
+			a.mapMu.Lock()
+			a.mu.Lock()
+			tt.change(a)
+			a.mu.Unlock()
+			a.mapMu.Unlock()
+			announced := make(chan error, 1)
+			go func() { announced <- a.updateLocalPath(ctx) }()
+			time.Sleep(50 * time.Millisecond)
+			close(hold)
+			<-switched
+			if err := <-announced; err != nil {
+				t.Fatal(err)
+			}
+
+			if n := prev.announced(); n != 0 {
+				t.Fatalf("previous endpoint still announces %d paths", n)
+			}
+			if n := next.announced(); n != tt.wantNext {
+				t.Fatalf("new endpoint announces %d paths, want %d", n, tt.wantNext)
+			}
+		})
+	}
+}
+
+func TestTransportCredentials(t *testing.T) {
+	tests := []struct {
+		name       string
+		tls        config.TLSConfig
+		addr       string
+		wantProto  string
+		wantServer string
+		wantErr    bool
+	}{
+		{name: "plaintext", addr: "gobgp.test:50051", wantProto: "insecure"},
+		{name: "host name from address", tls: config.TLSConfig{Enabled: true}, addr: "gobgp.test:50051", wantProto: "tls", wantServer: "gobgp.test"},
+		{name: "ipv4 from address", tls: config.TLSConfig{Enabled: true}, addr: "192.0.2.1:50051", wantProto: "tls", wantServer: "192.0.2.1"},
+		{name: "ipv6 from address", tls: config.TLSConfig{Enabled: true}, addr: "[2001:db8::1]:50051", wantProto: "tls", wantServer: "2001:db8::1"},
+		{name: "explicit server name", tls: config.TLSConfig{Enabled: true, ServerName: "gobgpd.example"}, addr: "192.0.2.1:50051", wantProto: "tls", wantServer: "gobgpd.example"},
+		{name: "address without port", tls: config.TLSConfig{Enabled: true}, addr: "gobgp.test", wantErr: true},
+		{name: "missing ca", tls: config.TLSConfig{Enabled: true, CAFile: "/nonexistent/ca.crt"}, addr: "gobgp.test:50051", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg config.Config
+			cfg.GoBGP.TLS = tt.tls
+			a := &Agent{cfg: cfg}
+			creds, err := a.transportCredentials(tt.addr)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			info := creds.Info()
+			if info.SecurityProtocol != tt.wantProto || info.ServerName != tt.wantServer {
+				t.Fatalf("protocol %q server name %q, want %q %q", info.SecurityProtocol, info.ServerName, tt.wantProto, tt.wantServer)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	api "github.com/osrg/gobgp/v3/api"
+	"github.com/osrg/gobgp/v3/pkg/apiutil"
+	apibgp "github.com/osrg/gobgp/v3/pkg/packet/bgp"
+
+	"gobgp-evpn-agent/internal/config"
+)
+
+var evpnFamily = &api.Family{Afi: api.Family_AFI_L2VPN, Safi: api.Family_SAFI_EVPN}
+
+// routeDistinguisher returns the configured RD or derives the
+// conventional <router-id>:<vni> (type 1) RD used by auto-RD implementations.
+// VNIs above 65535 keep their low 16 bits; the config rejects, and VNI
+// discovery skips, VNIs whose derived RDs would collide.
+func routeDistinguisher(rd string, vni uint32, routerID net.IP) (apibgp.RouteDistinguisherInterface, error) {
+	if rd != "" {
+		return apibgp.ParseRouteDistinguisher(rd)
+	}
+	if routerID.To4() == nil {
+		return nil, fmt.Errorf("no IPv4 router id to derive rd")
+	}
+	return apibgp.NewRouteDistinguisherIPAddressAS(routerID.String(), config.AutoRDIndex(vni)), nil
+}
+
+// newIMETPath builds the RFC 8365 Inclusive Multicast Ethernet Tag route
+// announcing localIP as an ingress-replication VTEP for the VNI, with encap
+// as its Tunnel Encapsulation attribute when set.
+func newIMETPath(v config.VNIConfig, localIP, routerID net.IP, encap apibgp.PathAttributeInterface) (*api.Path, error) {
+	rd, err := routeDistinguisher(v.RD, v.ID, routerID)
+	if err != nil {
+		return nil, fmt.Errorf("vni %d rd: %w", v.ID, err)
+	}
+	rt, err := config.ParseRouteTarget(v.RouteTarget)
+	if err != nil {
+		return nil, fmt.Errorf("vni %d route target: %w", v.ID, err)
+	}
+	ip := localIP.String()
+	nlri := apibgp.NewEVPNMulticastEthernetTagRoute(rd, 0, ip)
+	attrs := []apibgp.PathAttributeInterface{
+		apibgp.NewPathAttributeOrigin(0),
+		apibgp.NewPathAttributeMpReachNLRI(ip, []apibgp.AddrPrefixInterface{nlri}),
+		apibgp.NewPathAttributeExtendedCommunities([]apibgp.ExtendedCommunityInterface{
+			rt,
+			apibgp.NewEncapExtended(apibgp.TUNNEL_TYPE_VXLAN),
+		}),
+		apibgp.NewPathAttributePmsiTunnel(apibgp.PMSI_TUNNEL_TYPE_INGRESS_REPL, false, v.ID, apibgp.NewIngressReplTunnelID(ip)),
+	}
+	if encap != nil {
+		attrs = append(attrs, encap)
+	}
+	return apiutil.NewPath(nlri, false, attrs, time.Now())
+}
+
+// newVNIMembershipPath builds the per-VNI membership route of community
+// mode: a Type-3 route for the VNI that carries its membership community
+// in place of a route target. encap, when set, is attached as the Tunnel
+// Encapsulation attribute.
+func newVNIMembershipPath(v config.VNIConfig, vtep, routerID net.IP, encap apibgp.PathAttributeInterface, encoding, community string) (*api.Path, error) {
+	rd, err := routeDistinguisher(v.RD, v.ID, routerID)
+	if err != nil {
+		return nil, fmt.Errorf("vni %d rd: %w", v.ID, err)
+	}
+	ip := vtep.String()
+	nlri := apibgp.NewEVPNMulticastEthernetTagRoute(rd, 0, ip)
+	attrs := []apibgp.PathAttributeInterface{
+		apibgp.NewPathAttributeOrigin(0),
+		apibgp.NewPathAttributeMpReachNLRI(ip, []apibgp.AddrPrefixInterface{nlri}),
+		apibgp.NewPathAttributePmsiTunnel(apibgp.PMSI_TUNNEL_TYPE_INGRESS_REPL, false, v.ID, apibgp.NewIngressReplTunnelID(ip)),
+	}
+	vxlanEncap := apibgp.NewEncapExtended(apibgp.TUNNEL_TYPE_VXLAN)
+	if encoding == config.EncodingExtended {
+		rt, err := config.ParseRouteTarget(community)
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, apibgp.NewPathAttributeExtendedCommunities([]apibgp.ExtendedCommunityInterface{rt, vxlanEncap}))
+	} else {
+		comm, err := membershipAttribute(encoding, []string{community})
+		if err != nil {
+			return nil, err
+		}
+		attrs = append(attrs, comm, apibgp.NewPathAttributeExtendedCommunities([]apibgp.ExtendedCommunityInterface{vxlanEncap}))
+	}
+	if encap != nil {
+		attrs = append(attrs, encap)
+	}
+	return apiutil.NewPath(nlri, false, attrs, time.Now())
+}
+
+// parseIMETPath extracts the remote VTEP address and route targets from an
+// EVPN Type-3 path. The ingress-replication tunnel endpoint wins over the
+// originating router address when both are present.
+func parseIMETPath(p *api.Path) (string, []string, bool) {
+	nlri, err := apiutil.GetNativeNlri(p)
+	if err != nil {
+		return "", nil, false
+	}
+	evpn, ok := nlri.(*apibgp.EVPNNLRI)
+	if !ok {
+		return "", nil, false
+	}
+	imet, ok := evpn.RouteTypeData.(*apibgp.EVPNMulticastEthernetTagRoute)
+	if !ok {
+		return "", nil, false
+	}
+	attrs, err := apiutil.GetNativePathAttributes(p)
+	if err != nil {
+		return "", nil, false
+	}
+	vtep := imet.IPAddress
+	var rts []string
+	for _, attr := range attrs {
+		switch a := attr.(type) {
+		case *apibgp.PathAttributePmsiTunnel:
+			if id, ok := a.TunnelID.(*apibgp.IngressReplTunnelID); ok && a.TunnelType == apibgp.PMSI_TUNNEL_TYPE_INGRESS_REPL && id.Value != nil {
+				vtep = id.Value
+			}
+		case *apibgp.PathAttributeExtendedCommunities:
+			rts = append(rts, routeTargets(a.Value)...)
+		}
+	}
+	if vtep == nil {
+		return "", nil, false
+	}
+	return vtep.String(), rts, true
+}
+
+func routeTargets(comms []apibgp.ExtendedCommunityInterface) []string {
+	var res []string
+	for _, c := range comms {
+		if _, sub := c.GetTypes(); sub == apibgp.EC_SUBTYPE_ROUTE_TARGET {
+			res = append(res, c.String())
+		}
+	}
+	return res
+}
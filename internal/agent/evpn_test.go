@@ -0,0 +1,58 @@
+package agent
+
+import (
+	"net"
+	"testing"
+)
+
+func TestRouteDistinguisher(t *testing.T) {
+	routerID := net.ParseIP("10.0.0.1")
+	tests := []struct {
+		name     string
+		rd       string
+		vni      uint32
+		routerID net.IP
+		want     string
+		wantErr  bool
+	}{
+		{name: "derived", vni: 100, routerID: routerID, want: "10.0.0.1:100"},
+		{name: "derived max 16-bit", vni: 65535, routerID: routerID, want: "10.0.0.1:65535"},
+		{name: "derived 24-bit keeps low bits", vni: 65536 + 7, routerID: routerID, want: "10.0.0.1:7"},
+		{name: "explicit", rd: "65000:42", vni: 100, routerID: routerID, want: "65000:42"},
+		{name: "explicit without router id", rd: "65000:42", vni: 100, want: "65000:42"},
+		{name: "no ipv4 router id", vni: 100, routerID: net.ParseIP("2001:db8::1"), wantErr: true},
+		{name: "bad explicit", rd: "bogus", vni: 100, routerID: routerID, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rd, err := routeDistinguisher(tt.rd, tt.vni, tt.routerID)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("want error, got %v", rd)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := rd.String(); got != tt.want {
+				t.Fatalf("rd = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouteDistinguisherDistinctBelow16Bits(t *testing.T) {
+	routerID := net.ParseIP("10.0.0.1")
+	seen := make(map[string]uint32)
+	for vni := uint32(1); vni <= 0xffff; vni += 257 {
+		rd, err := routeDistinguisher("", vni, routerID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if other, ok := seen[rd.String()]; ok {
+			t.Fatalf("vni %d and %d share rd %s", other, vni, rd)
+		}
+		seen[rd.String()] = vni
+	}
+}
@@ -0,0 +1,226 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	api "github.com/osrg/gobgp/v3/api"
+	"github.com/osrg/gobgp/v3/pkg/apiutil"
+	apibgp "github.com/osrg/gobgp/v3/pkg/packet/bgp"
+
+	"gobgp-evpn-agent/internal/config"
+	"gobgp-evpn-agent/internal/vxlan"
+)
+
+// remotePrefix is an IP prefix learned from a remote Type-5 route.
+type remotePrefix struct {
+	vxlan.RemotePrefix
+	Prefix string
+}
+
+// newIPPrefixPath builds an EVPN Type-5 route for a VRF prefix carrying the
+// L3 VNI as label and the SVI MAC in the router-MAC extended community.
+func newIPPrefixPath(v config.L3VNIConfig, localIP, routerID net.IP, prefix *net.IPNet, rmac net.HardwareAddr) (*api.Path, error) {
+	rd, err := routeDistinguisher(v.RD, v.ID, routerID)
+	if err != nil {
+		return nil, fmt.Errorf("l3vni %d rd: %w", v.ID, err)
+	}
+	rt, err := config.ParseRouteTarget(v.RouteTarget)
+	if err != nil {
+		return nil, fmt.Errorf("l3vni %d route target: %w", v.ID, err)
+	}
+	ones, _ := prefix.Mask.Size()
+	gw := "0.0.0.0"
+	if prefix.IP.To4() == nil {
+		gw = "::"
+	}
+	esi := apibgp.EthernetSegmentIdentifier{Type: apibgp.ESI_ARBITRARY}
+	nlri := apibgp.NewEVPNIPPrefixRoute(rd, esi, 0, uint8(ones), prefix.IP.String(), gw, v.ID)
+	attrs := []apibgp.PathAttributeInterface{
+		apibgp.NewPathAttributeOrigin(0),
+		apibgp.NewPathAttributeMpReachNLRI(localIP.String(), []apibgp.AddrPrefixInterface{nlri}),
+		apibgp.NewPathAttributeExtendedCommunities([]apibgp.ExtendedCommunityInterface{
+			rt,
+			apibgp.NewEncapExtended(apibgp.TUNNEL_TYPE_VXLAN),
+			apibgp.NewRoutersMacExtended(rmac.String()),
+		}),
+	}
+	return apiutil.NewPath(nlri, false, attrs, time.Now())
+}
+
+// parseIPPrefixPath extracts the prefix, next-hop VTEP, router MAC and route
+// targets from an EVPN Type-5 path.
+func parseIPPrefixPath(p *api.Path) (string, remotePrefix, []string, bool) {
+	nlri, err := apiutil.GetNativeNlri(p)
+	if err != nil {
+		return "", remotePrefix{}, nil, false
+	}
+	evpn, ok := nlri.(*apibgp.EVPNNLRI)
+	if !ok {
+		return "", remotePrefix{}, nil, false
+	}
+	route, ok := evpn.RouteTypeData.(*apibgp.EVPNIPPrefixRoute)
+	if !ok {
+		return "", remotePrefix{}, nil, false
+	}
+	attrs, err := apiutil.GetNativePathAttributes(p)
+	if err != nil {
+		return "", remotePrefix{}, nil, false
+	}
+	var r remotePrefix
+	var rts []string
+	for _, attr := range attrs {
+		switch a := attr.(type) {
+		case *apibgp.PathAttributeMpReachNLRI:
+			r.VTEP = a.Nexthop.String()
+		case *apibgp.PathAttributeExtendedCommunities:
+			rts = append(rts, routeTargets(a.Value)...)
+			for _, c := range a.Value {
+				if rmac, ok := c.(*apibgp.RouterMacExtended); ok {
+					r.RouterMAC = rmac.Mac.String()
+				}
+			}
+		}
+	}
+	bits := 32
+	if route.IPPrefix.To4() == nil {
+		bits = 128
+	}
+	r.Prefix = (&net.IPNet{IP: route.IPPrefix, Mask: net.CIDRMask(int(route.IPPrefixLength), bits)}).String()
+	if r.VTEP == "" || (!p.IsWithdraw && r.RouterMAC == "") {
+		return "", remotePrefix{}, nil, false
+	}
+	return nlri.String(), r, rts, true
+}
+
+// ipPrefixEntries derives the remote prefix of a Type-5 route for each L3
+// VNI it targets. It reports whether the path was a Type-5 route.
+func (a *Agent) ipPrefixEntries(p *api.Path) ([]pathEntry, bool) {
+	if p.Family.Afi != api.Family_AFI_L2VPN || p.Family.Safi != api.Family_SAFI_EVPN {
+		return nil, false
+	}
+	key, route, rts, ok := parseIPPrefixPath(p)
+	if !ok {
+		return nil, false
+	}
+	if route.VTEP == a.localIP.String() {
+		return nil, true
+	}
+	var entries []pathEntry
+	for _, rt := range rts {
+		if v, ok := a.l3rtToVNI[rt]; ok {
+			entries = append(entries, pathEntry{kind: entryPrefix, vni: v.ID, key: key, prefix: route})
+		}
+	}
+	return entries, true
+}
+
+// snapshotPrefixes returns the desired prefix -> remote VTEP mapping for an
+// L3 VNI, dropping prefixes whose VTEP is of the other address family.
+func (a *Agent) snapshotPrefixes(vni uint32) map[string]vxlan.RemotePrefix {
+	a.desiredMu.Lock()
+	defer a.desiredMu.Unlock()
+	byPrefix := make(map[string][]vxlan.RemotePrefix)
+	skipped := make(map[string]struct{})
+	collect := func(set map[string]remotePrefix, fallback bool) {
+		for _, r := range set {
+			_, dst, err := net.ParseCIDR(r.Prefix)
+			vtep := net.ParseIP(r.VTEP)
+			if err != nil || vtep == nil {
+				continue
+			}
+			if (dst.IP.To4() == nil) != (vtep.To4() == nil) {
+				// The kernel cannot route a prefix via a gateway of the
+				// other family.
+				key := r.Prefix + " via " + r.VTEP
+				if _, warned := a.familySkipped[vni][key]; !warned {
+					slog.Warn("skip ip prefix route, vtep of other address family", "l3vni", vni, "prefix", r.Prefix, "vtep", r.VTEP)
+				}
+				skipped[key] = struct{}{}
+				continue
+			}
+			if _, live := byPrefix[r.Prefix]; fallback && live {
+				continue
+			}
+			byPrefix[r.Prefix] = append(byPrefix[r.Prefix], r.RemotePrefix)
+		}
+	}
+	collect(a.remotePrefixes[vni], false)
+	// Stale prefixes only fill in for prefixes not re-learned yet.
+	collect(a.stalePrefixes[vni], true)
+	a.familySkipped[vni] = skipped
+	res := make(map[string]vxlan.RemotePrefix, len(byPrefix))
+	for prefix, candidates := range byPrefix {
+		res[prefix] = vxlan.PickRemote(candidates)
+	}
+	return res
+}
+
+// syncL3VNI installs remote Type-5 prefixes into the VRF.
+func (a *Agent) syncL3VNI(vni uint32, mgr *vxlan.L3Manager) error {
+	if err := mgr.SyncRoutes(a.snapshotPrefixes(vni)); err != nil && !linkMissing(err) {
+		return fmt.Errorf("sync vrf routes: %w", err)
+	}
+	return nil
+}
+
+// advertisePrefixes diffs the VRF's connected/static prefixes against the
+// Type-5 routes already announced and adds or withdraws the difference.
+func (a *Agent) advertisePrefixes(ctx context.Context, vni uint32) {
+	mgr := a.l3Managers[vni]
+	v, ok := a.l3VNIs[vni]
+	if mgr == nil || !ok {
+		return
+	}
+	want := make(map[string]*net.IPNet)
+	prefixes, err := mgr.LocalPrefixes()
+	if err != nil {
+		if !linkMissing(err) {
+			slog.Debug("list vrf prefixes failed", "l3vni", vni, "err", err)
+		}
+	}
+	rmac := mgr.RouterMAC()
+	if err == nil && len(rmac) == 6 {
+		for _, prefix := range prefixes {
+			want[prefix.String()] = prefix
+		}
+	}
+
+	a.localPathMu.Lock()
+	defer a.localPathMu.Unlock()
+	have := a.localPrefixes[vni]
+	if have == nil {
+		have = make(map[string]*api.Path)
+		a.localPrefixes[vni] = have
+	}
+	for key, path := range have {
+		if _, ok := want[key]; ok {
+			continue
+		}
+		if _, err := a.gobgp().DeletePath(ctx, &api.DeletePathRequest{TableType: api.TableType_GLOBAL, Path: path}); err != nil {
+			slog.Warn("withdraw ip prefix route failed", "l3vni", vni, "prefix", key, "err", err)
+			continue
+		}
+		delete(have, key)
+		slog.Info("withdrew ip prefix route", "l3vni", vni, "prefix", key)
+	}
+	for key, prefix := range want {
+		if _, ok := have[key]; ok {
+			continue
+		}
+		path, err := newIPPrefixPath(v, a.localIP, a.routerID, prefix, rmac)
+		if err != nil {
+			slog.Warn("build ip prefix route failed", "l3vni", vni, "prefix", key, "err", err)
+			continue
+		}
+		if _, err := a.gobgp().AddPath(ctx, &api.AddPathRequest{TableType: api.TableType_GLOBAL, Path: path}); err != nil {
+			slog.Warn("advertise ip prefix route failed", "l3vni", vni, "prefix", key, "err", err)
+			continue
+		}
+		have[key] = path
+		slog.Info("advertised ip prefix route", "l3vni", vni, "prefix", key, "rmac", rmac.String())
+	}
+}
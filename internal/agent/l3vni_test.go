@@ -0,0 +1,48 @@
+package agent
+
+import (
+	"testing"
+
+	"gobgp-evpn-agent/internal/vxlan"
+)
+
+func prefix(p, vtep string) remotePrefix {
+	return remotePrefix{RemotePrefix: vxlan.RemotePrefix{VTEP: vtep, RouterMAC: "02:00:00:00:00:01"}, Prefix: p}
+}
+
+func TestSnapshotPrefixes(t *testing.T) {
+	a := &Agent{
+		remotePrefixes: map[uint32]map[string]remotePrefix{5000: {
+			"a": prefix("192.168.1.0/24", "10.0.0.9"),
+			"b": prefix("192.168.1.0/24", "10.0.0.2"),
+			"c": prefix("2001:db8:1::/64", "10.0.0.9"),
+		}},
+		stalePrefixes: map[uint32]map[string]remotePrefix{5000: {
+			"d": prefix("192.168.1.0/24", "10.0.0.1"),
+			"e": prefix("192.168.2.0/24", "10.0.0.7"),
+		}},
+		familySkipped: make(map[uint32]map[string]struct{}),
+	}
+	got := a.snapshotPrefixes(5000)
+	want := map[string]string{
+		// Live VTEPs win over stale ones; the lowest address breaks ties.
+		"192.168.1.0/24": "10.0.0.2",
+		"192.168.2.0/24": "10.0.0.7",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d prefixes, want %d: %v", len(got), len(want), got)
+	}
+	for p, vtep := range want {
+		if got[p].VTEP != vtep {
+			t.Errorf("%s via %s, want %s", p, got[p].VTEP, vtep)
+		}
+	}
+	if _, ok := a.familySkipped[5000]["2001:db8:1::/64 via 10.0.0.9"]; !ok {
+		t.Errorf("ipv6 prefix over ipv4 vtep not recorded: %v", a.familySkipped[5000])
+	}
+	delete(a.remotePrefixes[5000], "c")
+	a.snapshotPrefixes(5000)
+	if len(a.familySkipped[5000]) != 0 {
+		t.Errorf("withdrawn prefix still recorded: %v", a.familySkipped[5000])
+	}
+}
@@ -0,0 +1,313 @@
+package agent
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"time"
+
+	api "github.com/osrg/gobgp/v3/api"
+	"github.com/osrg/gobgp/v3/pkg/apiutil"
+	apibgp "github.com/osrg/gobgp/v3/pkg/packet/bgp"
+
+	"gobgp-evpn-agent/internal/config"
+	"gobgp-evpn-agent/internal/vxlan"
+)
+
+// remoteMAC is a MAC/IP binding learned from a remote Type-2 route.
+type remoteMAC struct {
+	vxlan.MACIP
+	VTEP string
+	// Seq and Sticky come from the MAC Mobility extended community.
+	Seq    uint32
+	Sticky bool
+}
+
+// preferMAC reports whether binding a wins over b for the same MAC, per
+// RFC 7432 section 15: a sticky MAC does not move, then the higher
+// mobility sequence number wins, then the lower VTEP address.
+func preferMAC(a, b remoteMAC) bool {
+	if a.Sticky != b.Sticky {
+		return a.Sticky
+	}
+	if a.Seq != b.Seq {
+		return a.Seq > b.Seq
+	}
+	return bytes.Compare(net.ParseIP(a.VTEP).To16(), net.ParseIP(b.VTEP).To16()) < 0
+}
+
+// newMACIPPath builds an EVPN Type-2 MAC/IP advertisement route for a local
+// binding, reusing the VNI's RD and route target. A non-zero seq is carried
+// in a MAC Mobility extended community.
+func newMACIPPath(v config.VNIConfig, localIP, routerID net.IP, b vxlan.MACIP, seq uint32) (*api.Path, error) {
+	rd, err := routeDistinguisher(v.RD, v.ID, routerID)
+	if err != nil {
+		return nil, fmt.Errorf("vni %d rd: %w", v.ID, err)
+	}
+	rt, err := config.ParseRouteTarget(v.RouteTarget)
+	if err != nil {
+		return nil, fmt.Errorf("vni %d route target: %w", v.ID, err)
+	}
+	var ip string
+	if b.IP != nil {
+		ip = b.IP.String()
+	}
+	esi := apibgp.EthernetSegmentIdentifier{Type: apibgp.ESI_ARBITRARY}
+	nlri := apibgp.NewEVPNMacIPAdvertisementRoute(rd, esi, 0, b.MAC.String(), ip, []uint32{v.ID})
+	ecs := []apibgp.ExtendedCommunityInterface{
+		rt,
+		apibgp.NewEncapExtended(apibgp.TUNNEL_TYPE_VXLAN),
+	}
+	if seq > 0 {
+		ecs = append(ecs, apibgp.NewMacMobilityExtended(seq, false))
+	}
+	attrs := []apibgp.PathAttributeInterface{
+		apibgp.NewPathAttributeOrigin(0),
+		apibgp.NewPathAttributeMpReachNLRI(localIP.String(), []apibgp.AddrPrefixInterface{nlri}),
+		apibgp.NewPathAttributeExtendedCommunities(ecs),
+	}
+	return apiutil.NewPath(nlri, false, attrs, time.Now())
+}
+
+// parseMACIPPath extracts the binding, next-hop VTEP and route targets from
+// an EVPN Type-2 path.
+func parseMACIPPath(p *api.Path) (string, remoteMAC, []string, bool) {
+	nlri, err := apiutil.GetNativeNlri(p)
+	if err != nil {
+		return "", remoteMAC{}, nil, false
+	}
+	evpn, ok := nlri.(*apibgp.EVPNNLRI)
+	if !ok {
+		return "", remoteMAC{}, nil, false
+	}
+	route, ok := evpn.RouteTypeData.(*apibgp.EVPNMacIPAdvertisementRoute)
+	if !ok || len(route.MacAddress) != 6 {
+		return "", remoteMAC{}, nil, false
+	}
+	attrs, err := apiutil.GetNativePathAttributes(p)
+	if err != nil {
+		return "", remoteMAC{}, nil, false
+	}
+	var nexthop net.IP
+	var rts []string
+	var mobility *apibgp.MacMobilityExtended
+	for _, attr := range attrs {
+		switch a := attr.(type) {
+		case *apibgp.PathAttributeMpReachNLRI:
+			nexthop = a.Nexthop
+		case *apibgp.PathAttributeNextHop:
+			nexthop = a.Value
+		case *apibgp.PathAttributeExtendedCommunities:
+			rts = append(rts, routeTargets(a.Value)...)
+			for _, ec := range a.Value {
+				if mm, ok := ec.(*apibgp.MacMobilityExtended); ok {
+					mobility = mm
+				}
+			}
+		}
+	}
+	if nexthop == nil {
+		return "", remoteMAC{}, nil, false
+	}
+	b := vxlan.MACIP{MAC: route.MacAddress}
+	if route.IPAddressLength > 0 && !route.IPAddress.IsUnspecified() {
+		b.IP = route.IPAddress
+	}
+	r := remoteMAC{MACIP: b, VTEP: nexthop.String()}
+	if mobility != nil {
+		r.Seq, r.Sticky = mobility.Sequence, mobility.IsSticky
+	}
+	return nlri.String(), r, rts, true
+}
+
+// macIPEntries derives the remote binding of a Type-2 route for each VNI it
+// targets. It reports whether the path was a Type-2 route.
+func (a *Agent) macIPEntries(p *api.Path) ([]pathEntry, bool) {
+	if p.Family.Afi != api.Family_AFI_L2VPN || p.Family.Safi != api.Family_SAFI_EVPN {
+		return nil, false
+	}
+	key, route, rts, ok := parseMACIPPath(p)
+	if !ok {
+		return nil, false
+	}
+	if route.VTEP == a.localIP.String() {
+		return nil, true
+	}
+	a.mapMu.Lock()
+	defer a.mapMu.Unlock()
+	var entries []pathEntry
+	for _, rt := range rts {
+		if vniCfg, ok := a.rtToVNI[rt]; ok {
+			entries = append(entries, pathEntry{kind: entryMAC, vni: vniCfg.ID, key: key, mac: route})
+		}
+	}
+	return entries, true
+}
+
+// snapshotMACs returns the desired MAC -> remote VTEP mapping for a VNI,
+// with the UDP port the VTEP announced for the VNI.
+func (a *Agent) snapshotMACs(vni uint32) map[string]vxlan.Endpoint {
+	a.desiredMu.Lock()
+	defer a.desiredMu.Unlock()
+	src, stale := a.remoteMACs[vni], a.staleMACs[vni]
+	if len(src) == 0 && len(stale) == 0 {
+		return nil
+	}
+	// Live bindings override stale ones for the same MAC. A MAC announced
+	// by several VTEPs, as while it moves, goes to the preferred binding.
+	best := make(map[string]remoteMAC, len(src)+len(stale))
+	for _, r := range src {
+		if cur, ok := best[r.MAC.String()]; !ok || preferMAC(r, cur) {
+			best[r.MAC.String()] = r
+		}
+	}
+	staleBest := make(map[string]remoteMAC, len(stale))
+	for _, r := range stale {
+		if cur, ok := staleBest[r.MAC.String()]; !ok || preferMAC(r, cur) {
+			staleBest[r.MAC.String()] = r
+		}
+	}
+	for mac, r := range staleBest {
+		if _, ok := best[mac]; !ok {
+			best[mac] = r
+		}
+	}
+	dst := make(map[string]vxlan.Endpoint, len(best))
+	for mac, r := range best {
+		dst[mac] = a.endpoint(vni, r.VTEP)
+	}
+	return dst
+}
+
+// mobilitySeqs returns, per MAC also announced by a remote VTEP, the MAC
+// Mobility sequence number a local route for it must carry: one above the
+// highest remote sequence number (RFC 7432 section 15).
+func (a *Agent) mobilitySeqs(vni uint32) map[string]uint32 {
+	a.desiredMu.Lock()
+	defer a.desiredMu.Unlock()
+	seqs := make(map[string]uint32)
+	for _, set := range []map[string]remoteMAC{a.remoteMACs[vni], a.staleMACs[vni]} {
+		for _, r := range set {
+			mac := r.MAC.String()
+			if seq, ok := seqs[mac]; !ok || r.Seq+1 > seq {
+				seqs[mac] = r.Seq + 1
+			}
+		}
+	}
+	return seqs
+}
+
+// endpoint returns the VTEP with the port its membership announced, live
+// state first. Caller must hold desiredMu.
+func (a *Agent) endpoint(vni uint32, vtep string) vxlan.Endpoint {
+	r, ok := a.desired[vni][vtep]
+	if !ok {
+		r = a.staleDesired[vni][vtep]
+	}
+	return vxlan.Endpoint{IP: vtep, Port: r.Port}
+}
+
+// snapshotNeighbors returns the desired IP -> MAC bindings for a VNI, used
+// to answer ARP/ND locally.
+func (a *Agent) snapshotNeighbors(vni uint32) map[string]string {
+	a.desiredMu.Lock()
+	defer a.desiredMu.Unlock()
+	src, stale := a.remoteMACs[vni], a.staleMACs[vni]
+	if len(src) == 0 && len(stale) == 0 {
+		return nil
+	}
+	dst := make(map[string]string, len(src)+len(stale))
+	for _, set := range []map[string]remoteMAC{stale, src} {
+		for _, r := range set {
+			if r.IP != nil {
+				dst[r.IP.String()] = r.MAC.String()
+			}
+		}
+	}
+	return dst
+}
+
+// advertiseMACs diffs the local MAC/IP bindings of an online VNI against
+// the Type-2 routes already announced and adds or withdraws the difference.
+// A binding whose MAC a remote VTEP announces with a sequence number not
+// below ours is announced again with a higher one, so remotes follow the
+// move.
+func (a *Agent) advertiseMACs(ctx context.Context, vni uint32) {
+	if !a.cfg.MACAdvertisement {
+		return
+	}
+	a.mapMu.Lock()
+	mgr := a.vxlanManagers[vni]
+	vCfg, ok := a.idToVNI[vni]
+	a.mapMu.Unlock()
+	if mgr == nil || !ok {
+		a.withdrawMACs(ctx, vni)
+		return
+	}
+	if online, _ := a.getOnline(vni); !online {
+		a.withdrawMACs(ctx, vni)
+		return
+	}
+	bindings, err := mgr.LocalMACs()
+	if err != nil {
+		slog.Debug("list local macs failed", "vni", vni, "err", err)
+		return
+	}
+	want := make(map[string]vxlan.MACIP, len(bindings))
+	for _, b := range bindings {
+		want[b.Key()] = b
+	}
+	seqs := a.mobilitySeqs(vni)
+
+	a.localPathMu.Lock()
+	defer a.localPathMu.Unlock()
+	have := a.localMACs[vni]
+	if have == nil {
+		have = make(map[string]*api.Path)
+		a.localMACs[vni] = have
+	}
+	for key, path := range have {
+		if _, ok := want[key]; ok {
+			continue
+		}
+		if _, err := a.gobgp().DeletePath(ctx, &api.DeletePathRequest{TableType: api.TableType_GLOBAL, Path: path}); err != nil {
+			slog.Warn("withdraw mac/ip route failed", "vni", vni, "binding", key, "err", err)
+			continue
+		}
+		delete(have, key)
+		slog.Debug("withdrew mac/ip route", "vni", vni, "binding", key)
+	}
+	for key, b := range want {
+		seq := seqs[b.MAC.String()]
+		if path, ok := have[key]; ok {
+			if _, cur, _, _ := parseMACIPPath(path); seq <= cur.Seq {
+				continue
+			}
+		}
+		path, err := newMACIPPath(vCfg, a.localIP, a.routerID, b, seq)
+		if err != nil {
+			slog.Warn("build mac/ip route failed", "vni", vni, "binding", key, "err", err)
+			continue
+		}
+		if _, err := a.gobgp().AddPath(ctx, &api.AddPathRequest{TableType: api.TableType_GLOBAL, Path: path}); err != nil {
+			slog.Warn("advertise mac/ip route failed", "vni", vni, "binding", key, "err", err)
+			continue
+		}
+		have[key] = path
+		slog.Debug("advertised mac/ip route", "vni", vni, "binding", key, "seq", seq)
+	}
+}
+
+// withdrawMACs removes every Type-2 route announced for the VNI.
+func (a *Agent) withdrawMACs(ctx context.Context, vni uint32) {
+	a.localPathMu.Lock()
+	defer a.localPathMu.Unlock()
+	for key, path := range a.localMACs[vni] {
+		if _, err := a.gobgp().DeletePath(ctx, &api.DeletePathRequest{TableType: api.TableType_GLOBAL, Path: path}); err != nil {
+			slog.Warn("withdraw mac/ip route failed", "vni", vni, "binding", key, "err", err)
+		}
+	}
+	delete(a.localMACs, vni)
+}
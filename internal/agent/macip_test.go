@@ -0,0 +1,143 @@
+package agent
+
+import (
+	"net"
+	"testing"
+
+	"gobgp-evpn-agent/internal/config"
+	"gobgp-evpn-agent/internal/vxlan"
+)
+
+func binding(mac, vtep string, seq uint32, sticky bool) remoteMAC {
+	hw, _ := net.ParseMAC(mac)
+	return remoteMAC{MACIP: vxlan.MACIP{MAC: hw}, VTEP: vtep, Seq: seq, Sticky: sticky}
+}
+
+func TestPreferMAC(t *testing.T) {
+	const mac = "02:00:00:00:00:01"
+	tests := []struct {
+		name string
+		a, b remoteMAC
+		want bool
+	}{
+		{"higher sequence", binding(mac, "10.0.0.9", 2, false), binding(mac, "10.0.0.2", 1, false), true},
+		{"lower sequence", binding(mac, "10.0.0.2", 1, false), binding(mac, "10.0.0.9", 2, false), false},
+		{"sticky beats higher sequence", binding(mac, "10.0.0.9", 0, true), binding(mac, "10.0.0.2", 5, false), true},
+		{"non-sticky loses", binding(mac, "10.0.0.2", 5, false), binding(mac, "10.0.0.9", 0, true), false},
+		{"tie lower vtep", binding(mac, "10.0.0.2", 3, false), binding(mac, "10.0.0.10", 3, false), true},
+		{"tie higher vtep", binding(mac, "10.0.0.10", 3, false), binding(mac, "10.0.0.2", 3, false), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := preferMAC(tt.a, tt.b); got != tt.want {
+				t.Fatalf("preferMAC = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSnapshotMACs(t *testing.T) {
+	const mac = "02:00:00:00:00:01"
+	tests := []struct {
+		name  string
+		live  map[string]remoteMAC
+		stale map[string]remoteMAC
+		want  string
+	}{
+		{
+			name: "moved mac follows sequence",
+			live: map[string]remoteMAC{
+				"old": binding(mac, "10.0.0.2", 0, false),
+				"new": binding(mac, "10.0.0.9", 1, false),
+			},
+			want: "10.0.0.9",
+		},
+		{
+			name:  "live overrides stale with higher sequence",
+			live:  map[string]remoteMAC{"a": binding(mac, "10.0.0.2", 0, false)},
+			stale: map[string]remoteMAC{"b": binding(mac, "10.0.0.9", 7, false)},
+			want:  "10.0.0.2",
+		},
+		{
+			name:  "stale only",
+			stale: map[string]remoteMAC{"b": binding(mac, "10.0.0.9", 0, false)},
+			want:  "10.0.0.9",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Repeat to cover map iteration orders.
+			for i := 0; i < 20; i++ {
+				a := &Agent{
+					remoteMACs: map[uint32]map[string]remoteMAC{100: tt.live},
+					staleMACs:  map[uint32]map[string]remoteMAC{100: tt.stale},
+				}
+				got := a.snapshotMACs(100)[mac]
+				if got.IP != tt.want {
+					t.Fatalf("vtep = %s, want %s", got.IP, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestLocalMACMobility(t *testing.T) {
+	const mac = "02:00:00:00:00:01"
+	tests := []struct {
+		name  string
+		live  map[string]remoteMAC
+		stale map[string]remoteMAC
+		want  uint32
+	}{
+		{name: "only local", want: 0},
+		{
+			name: "known remotely",
+			live: map[string]remoteMAC{"a": binding(mac, "10.0.0.9", 0, false)},
+			want: 1,
+		},
+		{
+			name: "above highest remote",
+			live: map[string]remoteMAC{
+				"a": binding(mac, "10.0.0.9", 4, false),
+				"b": binding(mac, "10.0.0.2", 2, false),
+			},
+			want: 5,
+		},
+		{
+			name:  "stale counts",
+			live:  map[string]remoteMAC{"a": binding(mac, "10.0.0.9", 1, false)},
+			stale: map[string]remoteMAC{"b": binding(mac, "10.0.0.2", 6, false)},
+			want:  7,
+		},
+		{
+			name: "other mac ignored",
+			live: map[string]remoteMAC{"a": binding("02:00:00:00:00:02", "10.0.0.9", 4, false)},
+			want: 0,
+		},
+	}
+	vCfg := config.VNIConfig{ID: 100, RouteTarget: "65000:100"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &Agent{
+				remoteMACs: map[uint32]map[string]remoteMAC{100: tt.live},
+				staleMACs:  map[uint32]map[string]remoteMAC{100: tt.stale},
+			}
+			seq := a.mobilitySeqs(100)[mac]
+			if seq != tt.want {
+				t.Fatalf("seq = %d, want %d", seq, tt.want)
+			}
+			local := binding(mac, "10.0.0.1", 0, false)
+			path, err := newMACIPPath(vCfg, net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.1"), local.MACIP, seq)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, got, _, ok := parseMACIPPath(path)
+			if !ok {
+				t.Fatal("path does not parse")
+			}
+			if got.Seq != tt.want || got.Sticky {
+				t.Fatalf("advertised seq %d sticky %v, want %d", got.Seq, got.Sticky, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+// eventDelay coalesces a burst of netlink events, such as the agent's own
+// FDB writes or a bridge learning many MACs, before the VNIs they concern
+// are queued.
+const eventDelay = 50 * time.Millisecond
+
+// watchKernel queues VNIs for reconcile as link, neighbor/FDB and, with L3
+// VNIs, route events arrive, so device changes and FDB tampering are handled
+// within milliseconds. A lost subscription is re-established with backoff,
+// followed by a full resync for the events missed meanwhile.
+func (a *Agent) watchKernel(ctx context.Context) {
+	var bo reconnectBackoff
+	for {
+		err := a.watchKernelOnce(ctx, &bo)
+		if ctx.Err() != nil {
+			return
+		}
+		delay := bo.next()
+		slog.Warn("netlink subscription lost, resubscribing", "err", err, "retryIn", delay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (a *Agent) watchKernelOnce(ctx context.Context, bo *reconnectBackoff) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	onErr := func(err error) { slog.Debug("netlink subscription error", "err", err) }
+	links := make(chan netlink.LinkUpdate, 64)
+	if err := netlink.LinkSubscribeWithOptions(links, ctx.Done(), netlink.LinkSubscribeOptions{ErrorCallback: onErr}); err != nil {
+		return err
+	}
+	neighs := make(chan netlink.NeighUpdate, 256)
+	if err := netlink.NeighSubscribeWithOptions(neighs, ctx.Done(), netlink.NeighSubscribeOptions{ErrorCallback: onErr}); err != nil {
+		return err
+	}
+	// Route events only matter for the VRF prefixes of L3 VNIs.
+	var routes chan netlink.RouteUpdate
+	if len(a.l3Managers) > 0 {
+		routes = make(chan netlink.RouteUpdate, 64)
+		if err := netlink.RouteSubscribeWithOptions(routes, ctx.Done(), netlink.RouteSubscribeOptions{ErrorCallback: onErr}); err != nil {
+			return err
+		}
+	}
+	a.resyncKernel(ctx)
+	bo.reset()
+
+	dirty := make(map[uint32]struct{})
+	refresh := false
+	var flush <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case u, ok := <-links:
+			if !ok {
+				return errors.New("link subscription closed")
+			}
+			if a.linkEvent(u.Link, dirty) {
+				refresh = true
+			}
+		case u, ok := <-neighs:
+			if !ok {
+				return errors.New("neighbor subscription closed")
+			}
+			a.neighEvent(u.Neigh, dirty)
+		case u, ok := <-routes:
+			if !ok {
+				return errors.New("route subscription closed")
+			}
+			a.routeEvent(u.Route, dirty)
+		case <-flush:
+			flush = nil
+			if refresh && a.dynamicVNI {
+				a.refreshDynamicVNIs(ctx)
+			}
+			for vni := range dirty {
+				a.queue.add(vni)
+			}
+			dirty = make(map[uint32]struct{})
+			refresh = false
+		}
+		if flush == nil && (refresh || len(dirty) > 0) {
+			flush = time.After(eventDelay)
+		}
+	}
+}
+
+// linkEvent marks the VNIs a link change concerns and reports whether the
+// dynamic VNI set must be refreshed.
+func (a *Agent) linkEvent(link netlink.Link, dirty map[uint32]struct{}) bool {
+	attrs := link.Attrs()
+	refresh := false
+	if vx, ok := link.(*netlink.Vxlan); ok && a.dynamicVNI && vx.VxlanId != 0 {
+		dirty[uint32(vx.VxlanId)] = struct{}{}
+		refresh = true
+	}
+	a.mapMu.Lock()
+	// Static devices are matched by name too, as one being created is
+	// not loaded yet.
+	for vni, v := range a.idToVNI {
+		if v.Device == attrs.Name {
+			dirty[vni] = struct{}{}
+		}
+	}
+	for vni, mgr := range a.vxlanManagers {
+		if mgr.Involves(attrs.Index, attrs.MasterIndex) {
+			dirty[vni] = struct{}{}
+		}
+	}
+	a.mapMu.Unlock()
+	for vni, v := range a.l3VNIs {
+		if attrs.Name == v.VRF || attrs.Name == v.Device || attrs.Name == v.SVI || a.l3Managers[vni].Involves(attrs.Index) {
+			dirty[vni] = struct{}{}
+		}
+	}
+	return refresh
+}
+
+// neighEvent marks the VNIs whose FDB, local MACs or neighbors a neighbor
+// or FDB change touches.
+func (a *Agent) neighEvent(n netlink.Neigh, dirty map[uint32]struct{}) {
+	a.mapMu.Lock()
+	for vni, mgr := range a.vxlanManagers {
+		if mgr.Involves(n.LinkIndex, n.MasterIndex) {
+			dirty[vni] = struct{}{}
+		}
+	}
+	a.mapMu.Unlock()
+	for vni, mgr := range a.l3Managers {
+		if mgr.Involves(n.LinkIndex) {
+			dirty[vni] = struct{}{}
+		}
+	}
+}
+
+// routeEvent marks the L3 VNI whose VRF table changed.
+func (a *Agent) routeEvent(r netlink.Route, dirty map[uint32]struct{}) {
+	for vni, mgr := range a.l3Managers {
+		if table := mgr.Table(); table != 0 && table == r.Table {
+			dirty[vni] = struct{}{}
+		}
+	}
+}
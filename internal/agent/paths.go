@@ -0,0 +1,190 @@
+package agent
+
+import (
+	"fmt"
+	"log/slog"
+
+	api "github.com/osrg/gobgp/v3/api"
+	"github.com/osrg/gobgp/v3/pkg/apiutil"
+
+	"gobgp-evpn-agent/internal/config"
+)
+
+// Kinds of remote state a path contributes to.
+const (
+	entryVTEP = iota
+	entryMAC
+	entryPrefix
+)
+
+// pathEntry is one piece of remote state derived from a path: a VTEP in a
+// VNI's flood list, a Type-2 binding or a Type-5 prefix.
+type pathEntry struct {
+	kind   int
+	vni    uint32
+	key    string
+	tunnel remoteVTEP
+	mac    remoteMAC
+	prefix remotePrefix
+}
+
+type entryID struct {
+	kind int
+	vni  uint32
+	key  string
+}
+
+func (e pathEntry) id() entryID { return entryID{e.kind, e.vni, e.key} }
+
+// vtep returns the remote VTEP the entry points at.
+func (e pathEntry) vtep() string {
+	switch e.kind {
+	case entryMAC:
+		return e.mac.VTEP
+	case entryPrefix:
+		return e.prefix.VTEP
+	}
+	return e.key
+}
+
+// pathRefs tracks which paths contribute which entries, so that an entry
+// stays while any path still carries it and a path that is replaced drops
+// what it no longer carries. Guarded by Agent.desiredMu.
+type pathRefs struct {
+	byPath  map[string][]entryID
+	byEntry map[entryID]map[string]struct{}
+}
+
+func newPathRefs() *pathRefs {
+	return &pathRefs{
+		byPath:  make(map[string][]entryID),
+		byEntry: make(map[entryID]map[string]struct{}),
+	}
+}
+
+// set records entries as the contribution of path and returns the entries
+// no path refers to anymore.
+func (r *pathRefs) set(path string, entries []pathEntry) []entryID {
+	old := r.byPath[path]
+	ids := make([]entryID, 0, len(entries))
+	for _, e := range entries {
+		id := e.id()
+		ids = append(ids, id)
+		if r.byEntry[id] == nil {
+			r.byEntry[id] = make(map[string]struct{})
+		}
+		r.byEntry[id][path] = struct{}{}
+	}
+	if len(ids) == 0 {
+		delete(r.byPath, path)
+	} else {
+		r.byPath[path] = ids
+	}
+	var released []entryID
+	for _, id := range old {
+		if containsID(ids, id) {
+			continue
+		}
+		refs := r.byEntry[id]
+		delete(refs, path)
+		if len(refs) == 0 {
+			delete(r.byEntry, id)
+			released = append(released, id)
+		}
+	}
+	return released
+}
+
+// held reports whether any path carries the entry.
+func (r *pathRefs) held(id entryID) bool {
+	return len(r.byEntry[id]) > 0
+}
+
+func containsID(ids []entryID, id entryID) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// pathKey identifies a path across updates. Only the best path of a route
+// is seen in best mode, so the route is the key and a new best replaces the
+// previous one. In all mode every advertiser's path, including ADD-PATH
+// copies, is tracked separately.
+func (a *Agent) pathKey(p *api.Path) (string, error) {
+	nlri, err := apiutil.GetNativeNlri(p)
+	if err != nil {
+		return "", err
+	}
+	if a.cfg.MembershipPaths == config.MembershipAll {
+		return fmt.Sprintf("%s|%d|%d/%d|%s", p.NeighborIp, p.Identifier, p.Family.Afi, p.Family.Safi, nlri.String()), nil
+	}
+	return fmt.Sprintf("%d/%d|%s", p.Family.Afi, p.Family.Safi, nlri.String()), nil
+}
+
+// pathEntries derives the remote state a path carries. Routes of the local
+// VTEP yield nothing.
+func (a *Agent) pathEntries(p *api.Path) []pathEntry {
+	if entries, ok := a.macIPEntries(p); ok {
+		return entries
+	}
+	if entries, ok := a.ipPrefixEntries(p); ok {
+		return entries
+	}
+	ip, vnis, ok := a.parseMembership(p)
+	if !ok || ip == a.localIP.String() {
+		return nil
+	}
+	tunnel, ok := tunnelCapabilities(p)
+	if !ok {
+		slog.Debug("ignoring vtep without vxlan encapsulation", "vtep", ip)
+		return nil
+	}
+	entries := make([]pathEntry, 0, len(vnis))
+	for _, vni := range vnis {
+		entries = append(entries, pathEntry{kind: entryVTEP, vni: vni, key: ip, tunnel: tunnel})
+	}
+	return entries
+}
+
+// applyEntry stores an entry in the live state. Caller must hold desiredMu.
+func (a *Agent) applyEntry(e pathEntry) {
+	switch e.kind {
+	case entryVTEP:
+		if a.desired[e.vni] == nil {
+			a.desired[e.vni] = make(map[string]remoteVTEP)
+		}
+		a.desired[e.vni][e.key] = e.tunnel
+	case entryMAC:
+		if a.remoteMACs[e.vni] == nil {
+			a.remoteMACs[e.vni] = make(map[string]remoteMAC)
+		}
+		a.remoteMACs[e.vni][e.key] = e.mac
+	case entryPrefix:
+		if a.remotePrefixes[e.vni] == nil {
+			a.remotePrefixes[e.vni] = make(map[string]remotePrefix)
+		}
+		a.remotePrefixes[e.vni][e.key] = e.prefix
+	}
+}
+
+// dropEntry removes an entry no path carries anymore from the live and
+// stale state. Caller must hold desiredMu.
+func (a *Agent) dropEntry(id entryID) {
+	switch id.kind {
+	case entryVTEP:
+		if _, ok := a.desired[id.vni][id.key]; ok {
+			a.damp.flap(dampKey{vni: id.vni, vtep: id.key})
+		}
+		delete(a.desired[id.vni], id.key)
+		delete(a.staleDesired[id.vni], id.key)
+	case entryMAC:
+		delete(a.remoteMACs[id.vni], id.key)
+		delete(a.staleMACs[id.vni], id.key)
+	case entryPrefix:
+		delete(a.remotePrefixes[id.vni], id.key)
+		delete(a.stalePrefixes[id.vni], id.key)
+	}
+}
@@ -0,0 +1,136 @@
+package agent
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	api "github.com/osrg/gobgp/v3/api"
+	"github.com/osrg/gobgp/v3/pkg/apiutil"
+	apibgp "github.com/osrg/gobgp/v3/pkg/packet/bgp"
+
+	"gobgp-evpn-agent/internal/config"
+)
+
+func vtepEntry(vni uint32, vtep string) pathEntry {
+	return pathEntry{kind: entryVTEP, vni: vni, key: vtep}
+}
+
+func TestPathRefs(t *testing.T) {
+	type step struct {
+		path     string
+		entries  []pathEntry
+		released []entryID
+	}
+	a100 := vtepEntry(100, "10.0.0.9")
+	a200 := vtepEntry(200, "10.0.0.9")
+	tests := []struct {
+		name  string
+		steps []step
+		held  []entryID
+	}{
+		{
+			name: "withdraw releases",
+			steps: []step{
+				{path: "p1", entries: []pathEntry{a100}},
+				{path: "p1", released: []entryID{a100.id()}},
+			},
+		},
+		{
+			name: "entry held while another path carries it",
+			steps: []step{
+				{path: "peer1", entries: []pathEntry{a100}},
+				{path: "peer2", entries: []pathEntry{a100}},
+				{path: "peer1"},
+			},
+			held: []entryID{a100.id()},
+		},
+		{
+			name: "last of several paths releases",
+			steps: []step{
+				{path: "peer1|1", entries: []pathEntry{a100}},
+				{path: "peer1|2", entries: []pathEntry{a100}},
+				{path: "peer1|1"},
+				{path: "peer1|2", released: []entryID{a100.id()}},
+			},
+		},
+		{
+			name: "replacement drops what it no longer carries",
+			steps: []step{
+				{path: "p1", entries: []pathEntry{a100, a200}},
+				{path: "p1", entries: []pathEntry{a200}, released: []entryID{a100.id()}},
+			},
+			held: []entryID{a200.id()},
+		},
+		{
+			name: "re-announcing the same entries releases nothing",
+			steps: []step{
+				{path: "p1", entries: []pathEntry{a100}},
+				{path: "p1", entries: []pathEntry{a100}},
+			},
+			held: []entryID{a100.id()},
+		},
+		{
+			name: "withdrawing an unknown path releases nothing",
+			steps: []step{
+				{path: "p1"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newPathRefs()
+			for i, s := range tt.steps {
+				got := r.set(s.path, s.entries)
+				if !slices.Equal(got, s.released) {
+					t.Fatalf("step %d: released %v, want %v", i, got, s.released)
+				}
+			}
+			for _, id := range tt.held {
+				if !r.held(id) {
+					t.Errorf("%v not held", id)
+				}
+			}
+			if len(r.byEntry) != len(tt.held) {
+				t.Errorf("%d entries referenced, want %d", len(r.byEntry), len(tt.held))
+			}
+		})
+	}
+}
+
+func TestPathKey(t *testing.T) {
+	nlri := apibgp.NewIPAddrPrefix(32, "10.0.0.9")
+	path := func(neighbor string, id uint32) *api.Path {
+		p, err := apiutil.NewPath(nlri, false, []apibgp.PathAttributeInterface{apibgp.NewPathAttributeOrigin(0)}, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.Family = &api.Family{Afi: api.Family_AFI_IP, Safi: api.Family_SAFI_UNICAST}
+		p.NeighborIp, p.Identifier = neighbor, id
+		return p
+	}
+	tests := []struct {
+		mode string
+		a, b *api.Path
+		same bool
+	}{
+		{config.MembershipBest, path("192.0.2.1", 0), path("192.0.2.2", 0), true},
+		{config.MembershipAll, path("192.0.2.1", 0), path("192.0.2.2", 0), false},
+		{config.MembershipAll, path("192.0.2.1", 1), path("192.0.2.1", 2), false},
+		{config.MembershipAll, path("192.0.2.1", 1), path("192.0.2.1", 1), true},
+	}
+	for _, tt := range tests {
+		a := &Agent{cfg: config.Config{MembershipPaths: tt.mode}}
+		ka, err := a.pathKey(tt.a)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kb, err := a.pathKey(tt.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (ka == kb) != tt.same {
+			t.Errorf("%s: keys %q and %q, same want %v", tt.mode, ka, kb, tt.same)
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"reflect"
+
+	api "github.com/osrg/gobgp/v3/api"
+
+	"gobgp-evpn-agent/internal/config"
+)
+
+// bgpConfig returns the bgp section currently in effect.
+func (a *Agent) bgpConfig() config.BGPConfig {
+	a.bgpMu.Lock()
+	defer a.bgpMu.Unlock()
+	return a.bgpCfg
+}
+
+// Reload applies a changed configuration. Only the bgp section and the log
+// level take effect at runtime; other changes are reported and need a
+// restart.
+func (a *Agent) Reload(ctx context.Context, cfg config.Config) error {
+	if cfg.BGP.Enabled != a.cfg.BGP.Enabled {
+		return fmt.Errorf("bgp.enabled cannot change at runtime, restart the agent")
+	}
+	next, cur := cfg, a.cfg
+	next.BGP, cur.BGP = config.BGPConfig{}, config.BGPConfig{}
+	next.LogLevel, cur.LogLevel = "", ""
+	if !reflect.DeepEqual(next, cur) {
+		slog.Warn("config changes outside the bgp section need a restart to apply")
+	}
+	a.bgpMu.Lock()
+	a.bgpCfg = cfg.BGP
+	a.bgpMu.Unlock()
+	switch {
+	case cfg.BGP.Enabled:
+		return a.reconcileBGP(ctx, a.endpoints[0].client, cfg.BGP)
+	case cfg.BGP.Manage:
+		return a.reconcileBGP(ctx, a.gobgp(), cfg.BGP)
+	}
+	return nil
+}
+
+// manageBGP converges the active endpoint's global config, peer groups,
+// dynamic neighbors and neighbors to the bgp section when the agent owns
+// them. Errors are logged; the next session or reload tries again.
+func (a *Agent) manageBGP(ctx context.Context) {
+	b := a.bgpConfig()
+	if !b.Manage || b.Enabled {
+		// The embedded speaker is configured when it starts and on reload.
+		return
+	}
+	if err := a.reconcileBGP(ctx, a.gobgp(), b); err != nil {
+		slog.Warn("converge gobgpd config failed", "err", err)
+	}
+}
+
+// reconcileBGP makes the speaker behind c match b. Peers not declared in b
+// are removed. Changed neighbors are re-created, which resets their session.
+func (a *Agent) reconcileBGP(ctx context.Context, c api.GobgpApiClient, b config.BGPConfig) error {
+	a.bgpReconcileMu.Lock()
+	defer a.bgpReconcileMu.Unlock()
+	ctx, cancel := context.WithTimeout(ctx, a.cfg.GoBGP.Timeout)
+	defer cancel()
+
+	routerID, err := a.bgpRouterID(b)
+	if err != nil {
+		return err
+	}
+	clusterID := b.ClusterID
+	if clusterID == "" {
+		clusterID = routerID
+	}
+	if err := ensureGlobal(ctx, c, b, routerID); err != nil {
+		return err
+	}
+
+	// Receiving ADD-PATH copies only pays off when all paths are consumed.
+	addPath := a.cfg.MembershipPaths == config.MembershipAll
+	wantGroups := make(map[string]*api.PeerGroup, len(b.PeerGroups))
+	groups := make(map[string]config.BGPPeerGroup, len(b.PeerGroups))
+	for _, g := range b.PeerGroups {
+		wantGroups[g.Name] = peerGroupFromConfig(g, clusterID, addPath)
+		groups[g.Name] = g
+	}
+	wantDynamic := make(map[string]string, len(b.DynamicNeighbors))
+	for _, d := range b.DynamicNeighbors {
+		wantDynamic[d.Prefix] = d.PeerGroup
+	}
+	wantPeers := make(map[string]*api.Peer, len(b.Neighbors))
+	for _, n := range b.Neighbors {
+		wantPeers[n.Address] = peerFromConfig(n, groups[n.PeerGroup], clusterID, addPath)
+	}
+
+	havePeers, err := listPeers(ctx, c)
+	if err != nil {
+		return err
+	}
+	haveDynamic, err := listDynamicNeighbors(ctx, c)
+	if err != nil {
+		return err
+	}
+	haveGroups, err := listPeerGroups(ctx, c)
+	if err != nil {
+		return err
+	}
+
+	// Remove in dependency order: neighbors, dynamic ranges, then groups.
+	for addr, have := range havePeers {
+		if want, ok := wantPeers[addr]; ok && samePeerSettings(have.Conf.GetPeerAsn(), have.EbgpMultihop, have.RouteReflector,
+			want.Conf.GetPeerAsn(), want.EbgpMultihop, want.RouteReflector) {
+			delete(wantPeers, addr)
+			continue
+		}
+		if _, err := c.DeletePeer(ctx, &api.DeletePeerRequest{Address: addr}); err != nil {
+			return fmt.Errorf("delete bgp neighbor %s: %w", addr, err)
+		}
+		slog.Info("removed bgp neighbor", "address", addr)
+	}
+	for prefix, group := range haveDynamic {
+		if wantDynamic[prefix] == group {
+			delete(wantDynamic, prefix)
+			continue
+		}
+		if _, err := c.DeleteDynamicNeighbor(ctx, &api.DeleteDynamicNeighborRequest{Prefix: prefix, PeerGroup: group}); err != nil {
+			return fmt.Errorf("delete bgp dynamic neighbor %s: %w", prefix, err)
+		}
+		slog.Info("removed bgp dynamic neighbor", "prefix", prefix, "peerGroup", group)
+	}
+	for name, have := range haveGroups {
+		want, ok := wantGroups[name]
+		if !ok {
+			if _, err := c.DeletePeerGroup(ctx, &api.DeletePeerGroupRequest{Name: name}); err != nil {
+				return fmt.Errorf("delete bgp peer group %s: %w", name, err)
+			}
+			slog.Info("removed bgp peer group", "name", name)
+			continue
+		}
+		delete(wantGroups, name)
+		if samePeerSettings(have.Conf.GetPeerAsn(), have.EbgpMultihop, have.RouteReflector,
+			want.Conf.GetPeerAsn(), want.EbgpMultihop, want.RouteReflector) {
+			continue
+		}
+		if _, err := c.UpdatePeerGroup(ctx, &api.UpdatePeerGroupRequest{PeerGroup: want}); err != nil {
+			return fmt.Errorf("update bgp peer group %s: %w", name, err)
+		}
+		slog.Info("updated bgp peer group", "name", name)
+	}
+
+	// Add in the reverse order.
+	for name, pg := range wantGroups {
+		if _, err := c.AddPeerGroup(ctx, &api.AddPeerGroupRequest{PeerGroup: pg}); err != nil {
+			return fmt.Errorf("add bgp peer group %s: %w", name, err)
+		}
+		slog.Info("added bgp peer group", "name", name)
+	}
+	for prefix, group := range wantDynamic {
+		if _, err := c.AddDynamicNeighbor(ctx, &api.AddDynamicNeighborRequest{DynamicNeighbor: &api.DynamicNeighbor{
+			Prefix:    prefix,
+			PeerGroup: group,
+		}}); err != nil {
+			return fmt.Errorf("add bgp dynamic neighbor %s: %w", prefix, err)
+		}
+		slog.Info("added bgp dynamic neighbor", "prefix", prefix, "peerGroup", group)
+	}
+	for addr, p := range wantPeers {
+		if _, err := c.AddPeer(ctx, &api.AddPeerRequest{Peer: p}); err != nil {
+			return fmt.Errorf("add bgp neighbor %s: %w", addr, err)
+		}
+		slog.Info("added bgp neighbor", "address", addr, "peerAsn", p.Conf.PeerAsn)
+	}
+	return nil
+}
+
+// peerFamilies are negotiated with every peer so one session carries both
+// membership encodings. With addPathReceive peers may send every path of a
+// route instead of only their best.
+func peerFamilies(addPathReceive bool) []*api.AfiSafi {
+	families := []*api.Family{
+		{Afi: api.Family_AFI_IP, Safi: api.Family_SAFI_UNICAST},
+		{Afi: api.Family_AFI_IP6, Safi: api.Family_SAFI_UNICAST},
+		evpnFamily,
+	}
+	res := make([]*api.AfiSafi, 0, len(families))
+	for _, f := range families {
+		as := &api.AfiSafi{Config: &api.AfiSafiConfig{Family: f, Enabled: true}}
+		if addPathReceive {
+			as.AddPaths = &api.AddPaths{Config: &api.AddPathsConfig{Receive: true}}
+		}
+		res = append(res, as)
+	}
+	return res
+}
+
+func peerGroupFromConfig(g config.BGPPeerGroup, clusterID string, addPathReceive bool) *api.PeerGroup {
+	pg := &api.PeerGroup{
+		Conf:     &api.PeerGroupConf{PeerGroupName: g.Name, PeerAsn: g.PeerASN},
+		AfiSafis: peerFamilies(addPathReceive),
+	}
+	if g.MultihopTTL > 0 {
+		pg.EbgpMultihop = &api.EbgpMultihop{Enabled: true, MultihopTtl: g.MultihopTTL}
+	}
+	if g.RRClient {
+		pg.RouteReflector = &api.RouteReflector{RouteReflectorClient: true, RouteReflectorClusterId: clusterID}
+	}
+	return pg
+}
+
+// peerFromConfig resolves a neighbor against its peer group. GoBGP lets a
+// group overwrite every field of a neighbor added over the API, so the
+// inheritance is applied here and the peer is added without the group.
+func peerFromConfig(n config.BGPNeighbor, g config.BGPPeerGroup, clusterID string, addPathReceive bool) *api.Peer {
+	if n.PeerASN == 0 {
+		n.PeerASN = g.PeerASN
+	}
+	if n.MultihopTTL == 0 {
+		n.MultihopTTL = g.MultihopTTL
+	}
+	n.RRClient = n.RRClient || g.RRClient
+	p := &api.Peer{
+		Conf:     &api.PeerConf{NeighborAddress: n.Address, PeerAsn: n.PeerASN},
+		AfiSafis: peerFamilies(addPathReceive),
+	}
+	if n.MultihopTTL > 0 {
+		p.EbgpMultihop = &api.EbgpMultihop{Enabled: true, MultihopTtl: n.MultihopTTL}
+	}
+	if n.RRClient {
+		p.RouteReflector = &api.RouteReflector{RouteReflectorClient: true, RouteReflectorClusterId: clusterID}
+	}
+	return p
+}
+
+// bgpRouterID resolves bgp.routerId, falling back to the agent's router id.
+func (a *Agent) bgpRouterID(b config.BGPConfig) (string, error) {
+	if b.RouterID != "" {
+		return b.RouterID, nil
+	}
+	if a.routerID == nil {
+		return "", fmt.Errorf("bgp.routerId is required on an IPv6 underlay")
+	}
+	return a.routerID.String(), nil
+}
+
+// ensureGlobal starts BGP on a speaker that has no global config yet. A
+// running speaker with a different ASN or router id is left alone: changing
+// either drops every session and the RIB, so it takes a gobgpd restart.
+func ensureGlobal(ctx context.Context, c api.GobgpApiClient, b config.BGPConfig, routerID string) error {
+	resp, err := c.GetBgp(ctx, &api.GetBgpRequest{})
+	if err != nil {
+		return fmt.Errorf("get bgp: %w", err)
+	}
+	g := resp.GetGlobal()
+	if g.GetAsn() == 0 {
+		if _, err := c.StartBgp(ctx, &api.StartBgpRequest{Global: &api.Global{
+			Asn:             b.ASN,
+			RouterId:        routerID,
+			ListenPort:      b.ListenPort,
+			ListenAddresses: b.ListenAddresses,
+		}}); err != nil {
+			return fmt.Errorf("start bgp: %w", err)
+		}
+		slog.Info("started bgp", "asn", b.ASN, "routerId", routerID, "port", b.ListenPort)
+		return nil
+	}
+	if g.GetAsn() != b.ASN || g.GetRouterId() != routerID {
+		slog.Warn("bgp global config differs from bgp section, restart the speaker to apply",
+			"asn", g.GetAsn(), "routerId", g.GetRouterId(), "wantAsn", b.ASN, "wantRouterId", routerID)
+	}
+	return nil
+}
+
+// samePeerSettings compares the settings the bgp section controls.
+func samePeerSettings(haveASN uint32, haveMH *api.EbgpMultihop, haveRR *api.RouteReflector,
+	wantASN uint32, wantMH *api.EbgpMultihop, wantRR *api.RouteReflector) bool {
+	ttl := func(m *api.EbgpMultihop) uint32 {
+		if !m.GetEnabled() {
+			return 0
+		}
+		return m.GetMultihopTtl()
+	}
+	cluster := func(r *api.RouteReflector) string {
+		if !r.GetRouteReflectorClient() {
+			return ""
+		}
+		return r.GetRouteReflectorClusterId()
+	}
+	return haveASN == wantASN && ttl(haveMH) == ttl(wantMH) &&
+		haveRR.GetRouteReflectorClient() == wantRR.GetRouteReflectorClient() && cluster(haveRR) == cluster(wantRR)
+}
+
+// listPeers returns the configured neighbors by address. Sessions accepted
+// through a dynamic neighbor range are not configuration and are skipped.
+func listPeers(ctx context.Context, c api.GobgpApiClient) (map[string]*api.Peer, error) {
+	stream, err := c.ListPeer(ctx, &api.ListPeerRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("list bgp neighbors: %w", err)
+	}
+	res := make(map[string]*api.Peer)
+	for {
+		r, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return res, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("list bgp neighbors: %w", err)
+		}
+		if addr := r.GetPeer().GetConf().GetNeighborAddress(); addr != "" {
+			res[addr] = r.Peer
+		}
+	}
+}
+
+func listPeerGroups(ctx context.Context, c api.GobgpApiClient) (map[string]*api.PeerGroup, error) {
+	stream, err := c.ListPeerGroup(ctx, &api.ListPeerGroupRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("list bgp peer groups: %w", err)
+	}
+	res := make(map[string]*api.PeerGroup)
+	for {
+		r, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return res, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("list bgp peer groups: %w", err)
+		}
+		if name := r.GetPeerGroup().GetConf().GetPeerGroupName(); name != "" {
+			res[name] = r.PeerGroup
+		}
+	}
+}
+
+// listDynamicNeighbors returns the dynamic neighbor ranges by prefix with
+// their peer group.
+func listDynamicNeighbors(ctx context.Context, c api.GobgpApiClient) (map[string]string, error) {
+	stream, err := c.ListDynamicNeighbor(ctx, &api.ListDynamicNeighborRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("list bgp dynamic neighbors: %w", err)
+	}
+	res := make(map[string]string)
+	for {
+		r, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return res, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("list bgp dynamic neighbors: %w", err)
+		}
+		if d := r.GetDynamicNeighbor(); d != nil {
+			res[d.Prefix] = d.PeerGroup
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package agent
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"regexp"
+	"slices"
+
+	api "github.com/osrg/gobgp/v3/api"
+	"github.com/osrg/gobgp/v3/pkg/apiutil"
+	apibgp "github.com/osrg/gobgp/v3/pkg/packet/bgp"
+
+	"gobgp-evpn-agent/internal/config"
+)
+
+// importPolicy is the compiled importPolicy section.
+type importPolicy struct {
+	allowed  []*net.IPNet
+	required []string
+	denied   []string
+	origins  []uint32
+	asPath   *regexp.Regexp
+	maxVTEPs int
+}
+
+// newImportPolicy compiles p, returning nil when it accepts everything.
+func newImportPolicy(p config.ImportPolicy) (*importPolicy, error) {
+	ip := &importPolicy{
+		origins:  p.OriginASNs,
+		maxVTEPs: p.MaxVTEPsPerVNI,
+	}
+	// Communities are compared in the form pathCommunities produces.
+	for _, raw := range p.RequiredCommunities {
+		c, err := config.ParsePolicyCommunity(raw)
+		if err != nil {
+			return nil, fmt.Errorf("import policy: %w", err)
+		}
+		ip.required = append(ip.required, c)
+	}
+	for _, raw := range p.DeniedCommunities {
+		c, err := config.ParsePolicyCommunity(raw)
+		if err != nil {
+			return nil, fmt.Errorf("import policy: %w", err)
+		}
+		ip.denied = append(ip.denied, c)
+	}
+	for _, cidr := range p.AllowedVTEPs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("import policy: %w", err)
+		}
+		ip.allowed = append(ip.allowed, n)
+	}
+	if p.ASPathRegex != "" {
+		re, err := regexp.Compile(p.ASPathRegex)
+		if err != nil {
+			return nil, fmt.Errorf("import policy: %w", err)
+		}
+		ip.asPath = re
+	}
+	if len(ip.allowed) == 0 && len(ip.required) == 0 && len(ip.denied) == 0 &&
+		len(ip.origins) == 0 && ip.asPath == nil && ip.maxVTEPs == 0 {
+		return nil, nil
+	}
+	return ip, nil
+}
+
+// check returns why a path with attrs announcing vteps is rejected, or ""
+// when it is accepted.
+func (ip *importPolicy) check(attrs []apibgp.PathAttributeInterface, vteps []string) string {
+	if len(ip.allowed) > 0 {
+		for _, v := range vteps {
+			if !ip.allows(net.ParseIP(v)) {
+				return "vtep " + v + " not in allowedVteps"
+			}
+		}
+	}
+	if len(ip.required) > 0 || len(ip.denied) > 0 {
+		comms := pathCommunities(attrs)
+		for _, c := range ip.required {
+			if !slices.Contains(comms, c) {
+				return "missing required community " + c
+			}
+		}
+		for _, c := range ip.denied {
+			if slices.Contains(comms, c) {
+				return "denied community " + c
+			}
+		}
+	}
+	if len(ip.origins) == 0 && ip.asPath == nil {
+		return ""
+	}
+	var asPath *apibgp.PathAttributeAsPath
+	for _, attr := range attrs {
+		if a, ok := attr.(*apibgp.PathAttributeAsPath); ok {
+			asPath = a
+		}
+	}
+	if len(ip.origins) > 0 {
+		if origin, ok := originAS(asPath); ok && !slices.Contains(ip.origins, origin) {
+			return fmt.Sprintf("origin as %d not in originAsns", origin)
+		}
+	}
+	if ip.asPath != nil {
+		s := ""
+		if asPath != nil {
+			s = apibgp.AsPathString(asPath)
+		}
+		if !ip.asPath.MatchString(s) {
+			return fmt.Sprintf("as path %q does not match asPathRegex", s)
+		}
+	}
+	return ""
+}
+
+func (ip *importPolicy) allows(vtep net.IP) bool {
+	for _, n := range ip.allowed {
+		if vtep != nil && n.Contains(vtep) {
+			return true
+		}
+	}
+	return false
+}
+
+// originAS returns the last AS of the path; ok is false for an empty path.
+func originAS(asPath *apibgp.PathAttributeAsPath) (uint32, bool) {
+	if asPath == nil {
+		return 0, false
+	}
+	for i := len(asPath.Value) - 1; i >= 0; i-- {
+		if as := asPath.Value[i].GetAS(); len(as) > 0 {
+			return as[len(as)-1], true
+		}
+	}
+	return 0, false
+}
+
+// pathCommunities lists the standard, large and route-target communities
+// of a path in their string forms.
+func pathCommunities(attrs []apibgp.PathAttributeInterface) []string {
+	var res []string
+	for _, attr := range attrs {
+		switch a := attr.(type) {
+		case *apibgp.PathAttributeCommunities:
+			for _, v := range a.Value {
+				res = append(res, fmt.Sprintf("%d:%d", v>>16, v&0xffff))
+			}
+		case *apibgp.PathAttributeLargeCommunities:
+			for _, v := range a.Values {
+				res = append(res, v.String())
+			}
+		case *apibgp.PathAttributeExtendedCommunities:
+			res = append(res, routeTargets(a.Value)...)
+		}
+	}
+	return res
+}
+
+// importEntries filters the entries of an announced path through the
+// import policy. A path failing a condition contributes nothing; a VTEP
+// beyond maxVtepsPerVni is left out of that VNI only. Caller must hold
+// desiredMu.
+func (a *Agent) importEntries(p *api.Path, entries []pathEntry) []pathEntry {
+	if a.policy == nil || len(entries) == 0 {
+		return entries
+	}
+	attrs, err := apiutil.GetNativePathAttributes(p)
+	if err != nil {
+		a.rejectPath(p, entries[0], "bad attributes")
+		return nil
+	}
+	var vteps []string
+	for _, e := range entries {
+		if v := e.vtep(); !slices.Contains(vteps, v) {
+			vteps = append(vteps, v)
+		}
+	}
+	if reason := a.policy.check(attrs, vteps); reason != "" {
+		a.rejectPath(p, entries[0], reason)
+		return nil
+	}
+	if a.policy.maxVTEPs == 0 {
+		return entries
+	}
+	kept := entries[:0:0]
+	for _, e := range entries {
+		if e.kind == entryVTEP {
+			if _, ok := a.desired[e.vni][e.key]; !ok && len(a.desired[e.vni]) >= a.policy.maxVTEPs {
+				a.rejectPath(p, e, "maxVtepsPerVni reached")
+				continue
+			}
+		}
+		kept = append(kept, e)
+	}
+	return kept
+}
+
+func (a *Agent) rejectPath(p *api.Path, e pathEntry, reason string) {
+	slog.Warn("import policy rejected path", "vni", e.vni, "vtep", e.vtep(),
+		"neighbor", p.NeighborIp, "reason", reason)
+	a.statusMu.Lock()
+	a.status.RejectedPaths++
+	a.statusMu.Unlock()
+}
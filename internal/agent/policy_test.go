@@ -0,0 +1,50 @@
+package agent
+
+import (
+	"testing"
+
+	apibgp "github.com/osrg/gobgp/v3/pkg/packet/bgp"
+
+	"gobgp-evpn-agent/internal/config"
+)
+
+func TestImportPolicyCommunities(t *testing.T) {
+	attrs := []apibgp.PathAttributeInterface{
+		apibgp.NewPathAttributeCommunities([]uint32{65000<<16 | 100}),
+		apibgp.NewPathAttributeLargeCommunities([]*apibgp.LargeCommunity{apibgp.NewLargeCommunity(65000, 0, 200)}),
+		apibgp.NewPathAttributeExtendedCommunities([]apibgp.ExtendedCommunityInterface{
+			apibgp.NewFourOctetAsSpecificExtended(apibgp.EC_SUBTYPE_ROUTE_TARGET, 4200000000, 7, true),
+		}),
+	}
+	tests := []struct {
+		name     string
+		required []string
+		denied   []string
+		rejected bool
+	}{
+		{name: "standard present", required: []string{"65000:100"}},
+		{name: "large present", required: []string{"65000:0:200"}},
+		{name: "4-byte route target in asplain", required: []string{"4200000000:7"}},
+		{name: "missing", required: []string{"65000:101"}, rejected: true},
+		{name: "denied standard", denied: []string{"65000:100"}, rejected: true},
+		{name: "denied absent", denied: []string{"65000:0:201"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip, err := newImportPolicy(config.ImportPolicy{RequiredCommunities: tt.required, DeniedCommunities: tt.denied})
+			if err != nil {
+				t.Fatal(err)
+			}
+			reason := ip.check(attrs, []string{"10.0.0.9"})
+			if (reason != "") != tt.rejected {
+				t.Fatalf("reason = %q, rejected want %v", reason, tt.rejected)
+			}
+		})
+	}
+}
+
+func TestImportPolicyRejectsBadCommunity(t *testing.T) {
+	if _, err := newImportPolicy(config.ImportPolicy{RequiredCommunities: []string{"foo:bar"}}); err == nil {
+		t.Fatal("want error for foo:bar")
+	}
+}
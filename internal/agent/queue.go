@@ -0,0 +1,114 @@
+package agent
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	retryBaseDelay = 100 * time.Millisecond
+	retryMaxDelay  = 30 * time.Second
+)
+
+// workQueue holds the VNIs waiting to be reconciled. A VNI is queued at
+// most once, and one added while a worker reconciles it is queued again
+// only when that worker is done, so no VNI is reconciled by two workers at
+// a time. A failed VNI comes back after a per-VNI exponential backoff.
+type workQueue struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	// items is the FIFO of queued VNIs; dirty holds every VNI waiting for
+	// a reconcile, whether in items or behind a running one.
+	items      []uint32
+	dirty      map[uint32]struct{}
+	processing map[uint32]struct{}
+	failures   map[uint32]int
+	closed     bool
+}
+
+func newWorkQueue() *workQueue {
+	q := &workQueue{
+		dirty:      make(map[uint32]struct{}),
+		processing: make(map[uint32]struct{}),
+		failures:   make(map[uint32]int),
+	}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// add queues vni unless it is already waiting.
+func (q *workQueue) add(vni uint32) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	if _, ok := q.dirty[vni]; ok {
+		return
+	}
+	q.dirty[vni] = struct{}{}
+	if _, ok := q.processing[vni]; ok {
+		return
+	}
+	q.items = append(q.items, vni)
+	q.cond.Signal()
+}
+
+// get blocks until a VNI is queued and hands it to the caller, who must
+// call done with it. It reports false once the queue is closed.
+func (q *workQueue) get() (uint32, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.items) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return 0, false
+	}
+	vni := q.items[0]
+	q.items = q.items[1:]
+	delete(q.dirty, vni)
+	q.processing[vni] = struct{}{}
+	return vni, true
+}
+
+// done releases vni and queues it again if it was added meanwhile.
+func (q *workQueue) done(vni uint32) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.processing, vni)
+	if _, ok := q.dirty[vni]; ok && !q.closed {
+		q.items = append(q.items, vni)
+		q.cond.Signal()
+	}
+}
+
+// retry queues vni again after its backoff, which doubles with every
+// consecutive failure.
+func (q *workQueue) retry(vni uint32) time.Duration {
+	q.mu.Lock()
+	delay := retryBaseDelay << q.failures[vni]
+	if delay <= 0 || delay > retryMaxDelay {
+		delay = retryMaxDelay
+	} else {
+		q.failures[vni]++
+	}
+	q.mu.Unlock()
+	time.AfterFunc(delay, func() { q.add(vni) })
+	return delay
+}
+
+// forget resets the backoff of vni after a successful reconcile.
+func (q *workQueue) forget(vni uint32) {
+	q.mu.Lock()
+	delete(q.failures, vni)
+	q.mu.Unlock()
+}
+
+// close wakes the workers and makes them return.
+func (q *workQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.cond.Broadcast()
+}
@@ -0,0 +1,161 @@
+package agent
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWorkQueue(t *testing.T) {
+	type step struct {
+		op  string // add, get or done
+		vni uint32
+	}
+	tests := []struct {
+		name  string
+		steps []step
+		want  []uint32 // queued VNIs afterwards, in order
+	}{
+		{
+			name:  "fifo",
+			steps: []step{{"add", 1}, {"add", 2}, {"add", 3}},
+			want:  []uint32{1, 2, 3},
+		},
+		{
+			name:  "dedup",
+			steps: []step{{"add", 1}, {"add", 2}, {"add", 1}, {"add", 2}},
+			want:  []uint32{1, 2},
+		},
+		{
+			name:  "re-add while processing waits",
+			steps: []step{{"add", 1}, {"get", 1}, {"add", 1}},
+			want:  nil,
+		},
+		{
+			name:  "done requeues re-added",
+			steps: []step{{"add", 1}, {"get", 1}, {"add", 1}, {"add", 1}, {"done", 1}},
+			want:  []uint32{1},
+		},
+		{
+			name:  "done without re-add",
+			steps: []step{{"add", 1}, {"add", 2}, {"get", 1}, {"done", 1}},
+			want:  []uint32{2},
+		},
+		{
+			name:  "others queue while processing",
+			steps: []step{{"add", 1}, {"get", 1}, {"add", 2}, {"add", 1}, {"done", 1}},
+			want:  []uint32{2, 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newWorkQueue()
+			for i, s := range tt.steps {
+				switch s.op {
+				case "add":
+					q.add(s.vni)
+				case "get":
+					vni, ok := q.get()
+					if !ok || vni != s.vni {
+						t.Fatalf("step %d: get = %d, %v, want %d, true", i, vni, ok, s.vni)
+					}
+				case "done":
+					q.done(s.vni)
+				}
+			}
+			var got []uint32
+			if len(q.items) > 0 {
+				got = q.items
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("queued = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWorkQueueClose(t *testing.T) {
+	q := newWorkQueue()
+	q.add(1)
+	res := make(chan bool)
+	go func() {
+		q.get()
+		_, ok := q.get()
+		res <- ok
+	}()
+	// Let the worker block on the empty queue before closing.
+	time.Sleep(10 * time.Millisecond)
+	q.close()
+	select {
+	case ok := <-res:
+		if ok {
+			t.Fatal("get after close reported a vni")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("close did not wake the blocked worker")
+	}
+	q.add(2)
+	q.done(1)
+	if len(q.items) != 0 {
+		t.Fatalf("closed queue took %v", q.items)
+	}
+}
+
+func TestWorkQueueRetry(t *testing.T) {
+	q := newWorkQueue()
+	defer q.close()
+	tests := []struct {
+		name string
+		vni  uint32
+		want time.Duration
+	}{
+		{"first failure", 1, retryBaseDelay},
+		{"second failure doubles", 1, 2 * retryBaseDelay},
+		{"third failure doubles", 1, 4 * retryBaseDelay},
+		{"other vni backs off alone", 2, retryBaseDelay},
+	}
+	for _, tt := range tests {
+		if got := q.retry(tt.vni); got != tt.want {
+			t.Fatalf("%s: retry = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	q.forget(1)
+	if got := q.retry(1); got != retryBaseDelay {
+		t.Fatalf("retry after forget = %v, want %v", got, retryBaseDelay)
+	}
+
+	// The delay is capped however often the vni fails.
+	var got time.Duration
+	for i := 0; i < 64; i++ {
+		got = q.retry(3)
+		if got > retryMaxDelay {
+			t.Fatalf("failure %d: retry = %v, above %v", i+1, got, retryMaxDelay)
+		}
+	}
+	if got != retryMaxDelay {
+		t.Fatalf("retry after many failures = %v, want %v", got, retryMaxDelay)
+	}
+}
+
+func TestWorkQueueRetryRequeues(t *testing.T) {
+	q := newWorkQueue()
+	defer q.close()
+	start := time.Now()
+	q.retry(1)
+	res := make(chan uint32)
+	go func() {
+		vni, _ := q.get()
+		res <- vni
+	}()
+	select {
+	case vni := <-res:
+		if vni != 1 {
+			t.Fatalf("got vni %d, want 1", vni)
+		}
+		if d := time.Since(start); d < retryBaseDelay {
+			t.Fatalf("requeued after %v, before the %v backoff", d, retryBaseDelay)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("failed vni was not queued again")
+	}
+}
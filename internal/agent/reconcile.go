@@ -0,0 +1,61 @@
+package agent
+
+import (
+	"context"
+	"log/slog"
+)
+
+// runWorker reconciles queued VNIs until the queue is closed. A failed VNI
+// is queued again with backoff.
+func (a *Agent) runWorker(ctx context.Context) {
+	for {
+		vni, ok := a.queue.get()
+		if !ok {
+			return
+		}
+		if err := a.reconcileVNI(ctx, vni); err != nil && ctx.Err() == nil {
+			delay := a.queue.retry(vni)
+			slog.Error("reconcile vni failed", "vni", vni, "err", err, "retryIn", delay)
+		} else {
+			a.queue.forget(vni)
+		}
+		a.queue.done(vni)
+	}
+}
+
+// reconcileVNI converges one VNI: its online state and membership
+// announcement, the FDB, neighbors or VRF routes from the desired state,
+// and the local MACs or prefixes announced. It is the only place kernel
+// state of a VNI is programmed.
+func (a *Agent) reconcileVNI(ctx context.Context, vni uint32) error {
+	if _, ok := a.l3Managers[vni]; ok {
+		a.advertisePrefixes(ctx, vni)
+		return a.syncVNI(ctx, vni)
+	}
+	// syncVNI settles the online state first.
+	if err := a.syncVNI(ctx, vni); err != nil {
+		return err
+	}
+	a.advertiseMACs(ctx, vni)
+	return nil
+}
+
+// enqueueAll queues every L2 and L3 VNI.
+func (a *Agent) enqueueAll() {
+	a.mapMu.Lock()
+	for vni := range a.vxlanManagers {
+		a.queue.add(vni)
+	}
+	a.mapMu.Unlock()
+	for vni := range a.l3Managers {
+		a.queue.add(vni)
+	}
+}
+
+// resyncKernel refreshes the dynamic VNI set and queues every VNI.
+func (a *Agent) resyncKernel(ctx context.Context) {
+	if a.dynamicVNI {
+		a.refreshDynamicVNIs(ctx)
+	}
+	a.enqueueAll()
+}
@@ -0,0 +1,357 @@
+package agent
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	api "github.com/osrg/gobgp/v3/api"
+	"github.com/osrg/gobgp/v3/pkg/apiutil"
+	apibgp "github.com/osrg/gobgp/v3/pkg/packet/bgp"
+)
+
+const (
+	reconnectBaseDelay = 500 * time.Millisecond
+	reconnectMaxDelay  = 30 * time.Second
+	// A watch session that stayed up this long resets the backoff.
+	reconnectStableAfter = 30 * time.Second
+)
+
+// Status is a point-in-time view of the agent's control-plane session.
+type Status struct {
+	Connected  bool      `json:"connected"`
+	Endpoint   string    `json:"endpoint"`
+	Since      time.Time `json:"since"`
+	LastError  string    `json:"lastError,omitempty"`
+	Reconnects int       `json:"reconnects"`
+	// Restarts counts detected gobgpd restarts that forced re-advertisement.
+	Restarts int `json:"restarts"`
+	// RejectedPaths counts received paths refused by the import policy.
+	RejectedPaths int `json:"rejectedPaths"`
+	// Dampened lists memberships with a flap penalty.
+	Dampened []Dampened `json:"dampened,omitempty"`
+}
+
+// Status returns the current session status.
+func (a *Agent) Status() Status {
+	a.statusMu.Lock()
+	s := a.status
+	a.statusMu.Unlock()
+	s.Dampened = a.damp.snapshot()
+	return s
+}
+
+func (a *Agent) setConnected(connected bool, err error) {
+	a.statusMu.Lock()
+	defer a.statusMu.Unlock()
+	if err != nil {
+		a.status.LastError = err.Error()
+	}
+	if a.status.Connected == connected {
+		return
+	}
+	a.status.Connected = connected
+	a.status.Since = time.Now()
+	if connected {
+		slog.Info("connected to gobgpd", "endpoint", a.status.Endpoint)
+	} else {
+		slog.Warn("disconnected from gobgpd", "endpoint", a.status.Endpoint, "err", err)
+	}
+}
+
+// reconnectBackoff yields exponentially growing reconnect delays with jitter
+// so a fleet of agents does not hammer a restarting gobgpd in lockstep.
+type reconnectBackoff struct {
+	attempt int
+}
+
+func (b *reconnectBackoff) next() time.Duration {
+	d := reconnectBaseDelay << b.attempt
+	if d <= 0 || d > reconnectMaxDelay {
+		d = reconnectMaxDelay
+	} else {
+		b.attempt++
+	}
+	// Equal jitter: half fixed, half random.
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+func (b *reconnectBackoff) reset() { b.attempt = 0 }
+
+// beginSession is called once a new watch stream is established. It
+// converges gobgpd's peers when the agent manages them. After a
+// failover it re-advertises everything on the new endpoint; after a stream
+// reset it checks whether gobgpd restarted (transport loss, the agent's own
+// path missing, or a changed identity) and, if so, re-advertises everything.
+func (a *Agent) beginSession(ctx context.Context) {
+	a.statusMu.Lock()
+	first := !a.sessionStarted
+	ep := a.endpoints[a.active]
+	lost, switched := ep.lost, a.switched
+	a.sessionStarted = true
+	ep.lost = false
+	a.switched = false
+	if !first {
+		a.status.Reconnects++
+	}
+	a.statusMu.Unlock()
+	a.setConnected(true, nil)
+	// Peers go first: a gobgpd started without config rejects paths until
+	// BGP is started on it.
+	a.manageBGP(ctx)
+	if first {
+		// The announcement in Run fails when gobgpd was not up yet.
+		if a.cfg.AdvertiseSelf {
+			if err := a.updateLocalPath(ctx); err != nil {
+				slog.Warn("advertise membership failed", "err", err)
+			}
+		}
+		a.recordIdentity(ctx)
+		return
+	}
+	if switched {
+		a.readvertise(ctx)
+		a.recordIdentity(ctx)
+		return
+	}
+	reason := "transport reset"
+	if !lost {
+		reason = a.restartReason(ctx)
+	}
+	if reason == "" {
+		return
+	}
+	slog.Warn("gobgpd restart detected, re-advertising local routes", "reason", reason)
+	a.statusMu.Lock()
+	a.status.Restarts++
+	a.statusMu.Unlock()
+	a.readvertise(ctx)
+	a.recordIdentity(ctx)
+}
+
+// recordIdentity remembers the current gobgpd for the next session.
+func (a *Agent) recordIdentity(ctx context.Context) {
+	id, err := a.probeIdentity(ctx)
+	if err != nil {
+		slog.Debug("probe gobgpd identity failed", "err", err)
+	}
+	a.identity = id
+}
+
+// sweepSession replaces the desired state with a fresh RIB snapshot at the
+// start of a watch session and reconciles every VNI against it, so remote
+// routes withdrawn while the stream was down are swept from the kernel.
+func (a *Agent) sweepSession(ctx context.Context) error {
+	a.desiredMu.Lock()
+	prev := make(map[uint32]map[string]struct{}, len(a.desired))
+	for vni, vteps := range a.desired {
+		prev[vni] = make(map[string]struct{}, len(vteps))
+		for vtep := range vteps {
+			prev[vni][vtep] = struct{}{}
+		}
+	}
+	a.desiredMu.Unlock()
+
+	if _, err := a.resyncRIB(ctx); err != nil {
+		return err
+	}
+
+	a.desiredMu.Lock()
+	for vni, vteps := range prev {
+		for vtep := range vteps {
+			if _, ok := a.desired[vni][vtep]; !ok {
+				slog.Info("sweeping vtep withdrawn while watch was down", "vni", vni, "vtep", vtep)
+			}
+		}
+	}
+	a.desiredMu.Unlock()
+
+	a.enqueueAll()
+	return nil
+}
+
+// gobgpdIdentity tells gobgpd instances apart across watch sessions.
+// GoBGP reports no server uptime, so the age it stamped on one of the
+// agent's own paths stands in for it: only a restart or a re-announcement
+// by the agent changes it.
+type gobgpdIdentity struct {
+	// global is the speaker's ASN, router ID and listen port.
+	global string
+	// probe is the local path looked up, age the age gobgpd reported for
+	// it and found whether gobgpd still held it.
+	probe *api.Path
+	age   time.Time
+	found bool
+}
+
+// restartReason compares gobgpd with what the previous session saw and
+// returns why it must have restarted, or "" when nothing points to it:
+// the agent's own path is gone, the speaker's global config changed, or
+// the path was re-stamped without the agent announcing it again.
+func (a *Agent) restartReason(ctx context.Context) string {
+	prev := a.identity
+	cur, err := a.probeIdentity(ctx)
+	if err != nil {
+		slog.Debug("probe gobgpd identity failed", "err", err)
+		return ""
+	}
+	a.identity = cur
+	switch {
+	case cur.probe != nil && !cur.found:
+		return "local path missing"
+	case prev.global != "" && prev.global != cur.global:
+		return "server identity changed"
+	case prev.found && cur.found && prev.probe == cur.probe && !prev.age.Equal(cur.age):
+		return "server uptime changed"
+	}
+	return ""
+}
+
+// probeIdentity reads the speaker's global config and looks up one of the
+// agent's announced paths among gobgpd's locally originated ones.
+func (a *Agent) probeIdentity(ctx context.Context) (gobgpdIdentity, error) {
+	ctx, cancel := context.WithTimeout(ctx, a.cfg.GoBGP.Timeout)
+	defer cancel()
+	var id gobgpdIdentity
+	resp, err := a.gobgp().GetBgp(ctx, &api.GetBgpRequest{})
+	if err != nil {
+		return id, fmt.Errorf("get bgp: %w", err)
+	}
+	if g := resp.GetGlobal(); g != nil {
+		id.global = fmt.Sprintf("%d/%s/%d", g.Asn, g.RouterId, g.ListenPort)
+	}
+	id.probe = a.probePath()
+	if id.probe == nil {
+		return id, nil
+	}
+	id.age, id.found, err = a.lookupLocalPath(ctx, id.probe)
+	return id, err
+}
+
+// probePath returns one announced local path, preferring the membership
+// route, or nil when nothing is announced.
+func (a *Agent) probePath() *api.Path {
+	a.localPathMu.Lock()
+	defer a.localPathMu.Unlock()
+	if a.localPath != nil {
+		return a.localPath
+	}
+	pick := func(paths map[uint32]*api.Path) *api.Path {
+		var best uint32
+		var path *api.Path
+		for vni, p := range paths {
+			if path == nil || vni < best {
+				best, path = vni, p
+			}
+		}
+		return path
+	}
+	if p := pick(a.localIMET); p != nil {
+		return p
+	}
+	for _, m := range []map[uint32]map[string]*api.Path{a.localMACs, a.localPrefixes} {
+		for _, paths := range m {
+			for _, p := range paths {
+				return p
+			}
+		}
+	}
+	return nil
+}
+
+// lookupLocalPath reports whether gobgpd holds path as a locally
+// originated route and the age it gave it.
+func (a *Agent) lookupLocalPath(ctx context.Context, path *api.Path) (time.Time, bool, error) {
+	nlri, err := apiutil.GetNativeNlri(path)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	key := nlri.String()
+	// EVPN destinations are filtered by route type, unicast ones by prefix.
+	filter := key
+	if evpn, ok := nlri.(*apibgp.EVPNNLRI); ok {
+		switch evpn.RouteType {
+		case apibgp.EVPN_INCLUSIVE_MULTICAST_ETHERNET_TAG:
+			filter = "multicast"
+		case apibgp.EVPN_ROUTE_TYPE_MAC_IP_ADVERTISEMENT:
+			filter = "macadv"
+		case apibgp.EVPN_IP_PREFIX:
+			filter = "prefix"
+		}
+	}
+	stream, err := a.gobgp().ListPath(ctx, &api.ListPathRequest{
+		TableType: api.TableType_GLOBAL,
+		Family:    path.Family,
+		Prefixes:  []*api.TableLookupPrefix{{Prefix: filter}},
+	})
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("list path: %w", err)
+	}
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			return time.Time{}, false, nil
+		}
+		if err != nil {
+			return time.Time{}, false, fmt.Errorf("list path recv: %w", err)
+		}
+		dest := resp.GetDestination()
+		if dest == nil || dest.Prefix != key {
+			continue
+		}
+		for _, p := range dest.Paths {
+			// Locally originated paths have no neighbor.
+			if ip := net.ParseIP(p.NeighborIp); ip == nil || ip.IsUnspecified() {
+				return p.GetAge().AsTime(), true, nil
+			}
+		}
+	}
+}
+
+// readvertise forgets which routes were announced so the next update
+// re-adds all of them, then triggers that update immediately.
+func (a *Agent) readvertise(ctx context.Context) {
+	a.localPathMu.Lock()
+	a.localPath = nil
+	a.localComms = nil
+	a.localIMET = make(map[uint32]*api.Path)
+	a.localMACs = make(map[uint32]map[string]*api.Path)
+	a.localPrefixes = make(map[uint32]map[string]*api.Path)
+	a.localPathMu.Unlock()
+
+	if a.cfg.AdvertiseSelf {
+		if err := a.updateLocalPath(ctx); err != nil {
+			slog.Warn("re-advertise membership failed", "err", err)
+		}
+	}
+	a.enqueueAll()
+}
+
+// serveStatus exposes Status as JSON; it answers 503 while disconnected so
+// it can back a readiness probe.
+func (a *Agent) serveStatus(ctx context.Context) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, _ *http.Request) {
+		st := a.Status()
+		w.Header().Set("Content-Type", "application/json")
+		if !st.Connected {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		_ = json.NewEncoder(w).Encode(st)
+	})
+	srv := &http.Server{Addr: a.cfg.StatusAddress, Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		<-ctx.Done()
+		_ = srv.Close()
+	}()
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("status server failed", "addr", a.cfg.StatusAddress, "err", err)
+	}
+}
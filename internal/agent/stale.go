@@ -0,0 +1,96 @@
+package agent
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// markStale moves the remote state learned so far into the stale set when
+// graceful restart is enabled. Stale entries keep forwarding until they are
+// re-learned, explicitly withdrawn or the stale time runs out.
+func (a *Agent) markStale() {
+	if !a.cfg.GracefulRestart.Enabled {
+		return
+	}
+	a.desiredMu.Lock()
+	defer a.desiredMu.Unlock()
+	moved := 0
+	for vni, vteps := range a.desired {
+		for vtep, r := range vteps {
+			if a.staleDesired[vni] == nil {
+				a.staleDesired[vni] = make(map[string]remoteVTEP)
+			}
+			a.staleDesired[vni][vtep] = r
+			moved++
+		}
+	}
+	for vni, macs := range a.remoteMACs {
+		for key, r := range macs {
+			if a.staleMACs[vni] == nil {
+				a.staleMACs[vni] = make(map[string]remoteMAC)
+			}
+			a.staleMACs[vni][key] = r
+			moved++
+		}
+	}
+	for vni, prefixes := range a.remotePrefixes {
+		for key, r := range prefixes {
+			if a.stalePrefixes[vni] == nil {
+				a.stalePrefixes[vni] = make(map[string]remotePrefix)
+			}
+			a.stalePrefixes[vni][key] = r
+			moved++
+		}
+	}
+	a.desired = make(map[uint32]map[string]remoteVTEP)
+	a.remoteMACs = make(map[uint32]map[string]remoteMAC)
+	a.remotePrefixes = make(map[uint32]map[string]remotePrefix)
+	a.refs = newPathRefs()
+	// Repeated failed reconnects move nothing and must not extend the timer.
+	if moved == 0 {
+		return
+	}
+	a.staleDeadline = time.Now().Add(a.cfg.GracefulRestart.StaleTime)
+	slog.Info("control plane lost, retaining remote entries as stale", "entries", moved, "staleTime", a.cfg.GracefulRestart.StaleTime)
+}
+
+// expireStale drops stale entries that were not re-learned once the stale
+// time has passed and reconciles every VNI.
+func (a *Agent) expireStale(ctx context.Context) {
+	a.desiredMu.Lock()
+	if a.staleDeadline.IsZero() || time.Now().Before(a.staleDeadline) {
+		a.desiredMu.Unlock()
+		return
+	}
+	expired := 0
+	for vni, vteps := range a.staleDesired {
+		for vtep := range vteps {
+			if _, ok := a.desired[vni][vtep]; !ok {
+				expired++
+			}
+		}
+	}
+	for vni, macs := range a.staleMACs {
+		for key := range macs {
+			if _, ok := a.remoteMACs[vni][key]; !ok {
+				expired++
+			}
+		}
+	}
+	for vni, prefixes := range a.stalePrefixes {
+		for key := range prefixes {
+			if _, ok := a.remotePrefixes[vni][key]; !ok {
+				expired++
+			}
+		}
+	}
+	a.staleDesired = make(map[uint32]map[string]remoteVTEP)
+	a.staleMACs = make(map[uint32]map[string]remoteMAC)
+	a.stalePrefixes = make(map[uint32]map[string]remotePrefix)
+	a.staleDeadline = time.Time{}
+	a.desiredMu.Unlock()
+
+	slog.Info("stale time expired, removing entries not re-learned", "entries", expired)
+	a.enqueueAll()
+}
@@ -0,0 +1,184 @@
+package agent
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"net"
+
+	api "github.com/osrg/gobgp/v3/api"
+	"github.com/osrg/gobgp/v3/pkg/apiutil"
+	apibgp "github.com/osrg/gobgp/v3/pkg/packet/bgp"
+
+	"gobgp-evpn-agent/internal/config"
+)
+
+// membershipPrefix returns the address announced as the membership host
+// route. With the prefix source it is the VTEP itself; the other sources
+// carry the VTEP elsewhere and announce the router id, which stays unique
+// per node when the tunnel address is shared or differs from it. IPv6 VTEPs
+// keep their own /128 since the router id is IPv4.
+func (a *Agent) membershipPrefix() net.IP {
+	if a.cfg.VTEPSource == config.VTEPSourcePrefix || a.localIP.To4() == nil || a.routerID == nil {
+		return a.localIP
+	}
+	return a.routerID
+}
+
+// membershipVTEP returns the remote VTEP address of a community membership
+// route according to source, or nil when the route does not carry one.
+func membershipVTEP(source string, nlri apibgp.AddrPrefixInterface, attrs []apibgp.PathAttributeInterface) net.IP {
+	switch source {
+	case config.VTEPSourceNextHop:
+		for _, attr := range attrs {
+			switch a := attr.(type) {
+			case *apibgp.PathAttributeNextHop:
+				return usableVTEP(a.Value)
+			case *apibgp.PathAttributeMpReachNLRI:
+				return usableVTEP(a.Nexthop)
+			}
+		}
+		return nil
+	case config.VTEPSourceTunnelEncap:
+		for _, attr := range attrs {
+			te, ok := attr.(*apibgp.PathAttributeTunnelEncap)
+			if !ok {
+				continue
+			}
+			for _, tlv := range te.Value {
+				if tlv.Type != apibgp.TUNNEL_TYPE_VXLAN {
+					continue
+				}
+				for _, sub := range tlv.Value {
+					if ep, ok := sub.(*apibgp.TunnelEncapSubTLVEgressEndpoint); ok {
+						return usableVTEP(ep.Address)
+					}
+				}
+			}
+		}
+		return nil
+	default:
+		switch prefix := nlri.(type) {
+		case *apibgp.IPAddrPrefix:
+			if prefix.Length == 32 {
+				return prefix.Prefix
+			}
+		case *apibgp.IPv6AddrPrefix:
+			if prefix.Length == 128 {
+				return prefix.Prefix
+			}
+		}
+		return nil
+	}
+}
+
+// usableVTEP rejects unspecified addresses, such as the 0.0.0.0 next hop of
+// a route originated without one.
+func usableVTEP(ip net.IP) net.IP {
+	if ip == nil || ip.IsUnspecified() {
+		return nil
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip
+}
+
+// remoteVTEP holds what a remote VTEP announced about its tunnel endpoint.
+// Zero values mean not announced.
+type remoteVTEP struct {
+	Port uint16
+	MTU  uint16
+}
+
+// mtuSubTLV carries the VTEP's MTU in the VXLAN tunnel TLV. RFC 9012 has no
+// MTU sub-TLV, so a type from the experimental range is used; other
+// implementations ignore it.
+const mtuSubTLV apibgp.EncapSubTLVType = 126
+
+// tunnelEncapAttribute announces vtep as the egress endpoint of a VXLAN
+// tunnel (RFC 9012), with its UDP port and MTU when non-zero.
+func tunnelEncapAttribute(vtep net.IP, port, mtu uint16) apibgp.PathAttributeInterface {
+	subs := []apibgp.TunnelEncapSubTLVInterface{apibgp.NewTunnelEncapSubTLVEgressEndpoint(vtep.String())}
+	if port != 0 {
+		subs = append(subs, apibgp.NewTunnelEncapSubTLVUDPDestPort(port))
+	}
+	if mtu != 0 {
+		v := make([]byte, 2)
+		binary.BigEndian.PutUint16(v, mtu)
+		subs = append(subs, apibgp.NewTunnelEncapSubTLVUnknown(mtuSubTLV, v))
+	}
+	return apibgp.NewPathAttributeTunnelEncap([]*apibgp.TunnelEncapTLV{
+		apibgp.NewTunnelEncapTLV(apibgp.TUNNEL_TYPE_VXLAN, subs),
+	})
+}
+
+// localTunnelEncap returns the Tunnel Encapsulation attribute for local
+// membership routes, or nil when neither vtepSource nor tunnelEncap asks
+// for one.
+func (a *Agent) localTunnelEncap() apibgp.PathAttributeInterface {
+	te := a.cfg.TunnelEncap
+	if te.Advertise {
+		return tunnelEncapAttribute(a.localIP, a.cfg.Node.VXLANPort, te.MTU)
+	}
+	if a.cfg.VTEPSource == config.VTEPSourceTunnelEncap {
+		return tunnelEncapAttribute(a.localIP, 0, 0)
+	}
+	return nil
+}
+
+// tunnelCapabilities reads the VXLAN tunnel a path announces. It reports
+// false when the path names encapsulations but VXLAN is not among them, as
+// with a Geneve-only VTEP that this node cannot reach.
+func tunnelCapabilities(p *api.Path) (remoteVTEP, bool) {
+	attrs, err := apiutil.GetNativePathAttributes(p)
+	if err != nil {
+		return remoteVTEP{}, true
+	}
+	var r remoteVTEP
+	announced, vxlan := false, false
+	for _, attr := range attrs {
+		switch a := attr.(type) {
+		case *apibgp.PathAttributeTunnelEncap:
+			for _, tlv := range a.Value {
+				announced = true
+				if tlv.Type != apibgp.TUNNEL_TYPE_VXLAN {
+					continue
+				}
+				vxlan = true
+				for _, sub := range tlv.Value {
+					switch s := sub.(type) {
+					case *apibgp.TunnelEncapSubTLVUDPDestPort:
+						r.Port = s.UDPDestPort
+					case *apibgp.TunnelEncapSubTLVUnknown:
+						if s.Type == mtuSubTLV && len(s.Value) == 2 {
+							r.MTU = binary.BigEndian.Uint16(s.Value)
+						}
+					}
+				}
+			}
+		case *apibgp.PathAttributeExtendedCommunities:
+			for _, c := range a.Value {
+				if e, ok := c.(*apibgp.EncapExtended); ok {
+					announced = true
+					vxlan = vxlan || e.TunnelType == apibgp.TUNNEL_TYPE_VXLAN
+				}
+			}
+		}
+	}
+	return r, vxlan || !announced
+}
+
+// warnRemoteMTU logs once per VTEP and MTU when a remote announces a
+// smaller MTU than the local device's, as larger frames would be dropped.
+func (a *Agent) warnRemoteMTU(vni uint32, local int, remotes map[string]remoteVTEP) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for ip, r := range remotes {
+		k := dampKey{vni: vni, vtep: ip}
+		if r.MTU == 0 || int(r.MTU) >= local || a.mtuWarned[k] == r.MTU {
+			continue
+		}
+		a.mtuWarned[k] = r.MTU
+		slog.Warn("remote vtep announces a smaller mtu than the local device", "vni", vni, "vtep", ip, "mtu", r.MTU, "localMtu", local)
+	}
+}
@@ -2,46 +2,279 @@ package config
 
 import (
 	"fmt"
+	"math"
 	"net"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
 
+	apibgp "github.com/osrg/gobgp/v3/pkg/packet/bgp"
 	"gopkg.in/yaml.v3"
 )
 
+// Membership advertisement modes.
+const (
+	// ModeCommunity announces the local VTEP as a host route (IPv4 /32 or
+	// IPv6 /128) tagged with one membership community per VNI.
+	ModeCommunity = "community"
+	// ModeEVPN announces one RFC 8365 Inclusive Multicast Ethernet Tag
+	// route (EVPN Type-3) per VNI in the L2VPN-EVPN family.
+	ModeEVPN = "evpn"
+)
+
+// Membership encodings used in community mode.
+const (
+	// EncodingStandard is the RFC 1997 ASN:VNI community; both halves are
+	// limited to 16 bits. Kept for compatibility with existing fabrics.
+	EncodingStandard = "standard"
+	// EncodingLarge is the RFC 8092 large community ASN:0:VNI, which carries
+	// 4-byte ASNs and 24-bit VNIs.
+	EncodingLarge = "large"
+	// EncodingExtended is a route-target extended community ASN:VNI
+	// (2-byte ASN with 32-bit value, or 4-byte ASN with 16-bit value).
+	EncodingExtended = "extended"
+)
+
+// Sources of the remote VTEP address of a community membership route.
+const (
+	// VTEPSourcePrefix uses the host route itself as the VTEP address.
+	VTEPSourcePrefix = "prefix"
+	// VTEPSourceNextHop uses the route's BGP next hop, so a route may be
+	// announced on behalf of another VTEP.
+	VTEPSourceNextHop = "nextHop"
+	// VTEPSourceTunnelEncap uses the tunnel egress endpoint of the RFC 9012
+	// Tunnel Encapsulation attribute (VXLAN tunnel type).
+	VTEPSourceTunnelEncap = "tunnelEncap"
+)
+
+// How community mode announces the local VNIs.
+const (
+	// AdvertiseAggregate announces one host route carrying every VNI's
+	// community.
+	AdvertiseAggregate = "aggregate"
+	// AdvertisePerVNI announces an EVPN Type-3 route per VNI, with an RD of
+	// its own, carrying that VNI's community.
+	AdvertisePerVNI = "perVni"
+)
+
+// Paths that count towards VNI membership.
+const (
+	// MembershipBest uses only the best path of each route.
+	MembershipBest = "best"
+	// MembershipAll uses every received path, including ADD-PATH copies;
+	// a VTEP is a member of the union of VNIs over its live paths.
+	MembershipAll = "all"
+)
+
+// What the agent removes on exit.
+const (
+	// CleanupDeleteOwned deletes the VXLAN devices the agent created and
+	// removes the FDB entries it programmed on the others.
+	CleanupDeleteOwned = "deleteOwned"
+	// CleanupFlushFDB keeps every device and removes only the FDB entries
+	// the agent programmed.
+	CleanupFlushFDB = "flushFdb"
+	// CleanupNone leaves devices and entries in place.
+	CleanupNone = "none"
+)
+
+// What the agent does with a VXLAN device whose attributes differ from
+// the configuration.
+const (
+	// RepairReport logs each mismatch and keeps using the device.
+	RepairReport = "report"
+	// RepairRecreateOwned recreates mismatching devices the agent created
+	// and only reports the others.
+	RepairRecreateOwned = "recreateOwned"
+	// RepairRecreate recreates every mismatching device of a static VNI.
+	RepairRecreate = "recreate"
+)
+
+// Underlay address families used to pick the local VTEP address.
+const (
+	FamilyIPv4 = "ipv4"
+	FamilyIPv6 = "ipv6"
+)
+
 // Config is the top-level configuration for the EVPN agent.
 type Config struct {
-	LogLevel      string      `yaml:"logLevel"`
-	AdvertiseSelf bool        `yaml:"advertiseSelf"`
-	CommunityASN  uint32      `yaml:"communityAsn"`
-	GoBGP         GoBGPConfig `yaml:"gobgp"`
-	Node          NodeConfig  `yaml:"node"`
-	VNIs          []VNIConfig `yaml:"vnis"`
+	LogLevel                string        `yaml:"logLevel"`
+	Mode                    string        `yaml:"mode"`
+	AdvertiseSelf           bool          `yaml:"advertiseSelf"`
+	MACAdvertisement        bool          `yaml:"macAdvertisement"`
+	CommunityASN            uint32        `yaml:"communityAsn"`
+	CommunityEncoding       string        `yaml:"communityEncoding"`
+	VTEPSource              string        `yaml:"vtepSource"`
+	MembershipAdvertisement string        `yaml:"membershipAdvertisement"`
+	MembershipPaths         string        `yaml:"membershipPaths"`
+	ImportPolicy            ImportPolicy  `yaml:"importPolicy"`
+	StatusAddress           string        `yaml:"statusAddress"`
+	GracefulRestart         GRConfig      `yaml:"gracefulRestart"`
+	Dampening               Dampening     `yaml:"dampening"`
+	TunnelEncap             TunnelEncap   `yaml:"tunnelEncap"`
+	GoBGP                   GoBGPConfig   `yaml:"gobgp"`
+	BGP                     BGPConfig     `yaml:"bgp"`
+	Node                    NodeConfig    `yaml:"node"`
+	VNIs                    []VNIConfig   `yaml:"vnis"`
+	L3VNIs                  []L3VNIConfig `yaml:"l3vnis"`
 }
 
 // GoBGPConfig defines how the agent talks to gobgpd.
 type GoBGPConfig struct {
-	Address string        `yaml:"address"`
-	Timeout time.Duration `yaml:"timeout"`
+	Address string `yaml:"address"`
+	// Endpoints lists gobgpd addresses in order of preference; the agent
+	// fails over to the next healthy one and back. Defaults to [Address].
+	Endpoints []string      `yaml:"endpoints"`
+	Timeout   time.Duration `yaml:"timeout"`
+	TLS       TLSConfig     `yaml:"tls"`
+}
+
+// TLSConfig secures the gRPC channel to gobgpd. The server certificate is
+// verified against CAFile (system roots when empty); CertFile/KeyFile add a
+// client certificate for mutual TLS.
+type TLSConfig struct {
+	Enabled    bool   `yaml:"enabled"`
+	CAFile     string `yaml:"caFile"`
+	CertFile   string `yaml:"certFile"`
+	KeyFile    string `yaml:"keyFile"`
+	ServerName string `yaml:"serverName"`
+	// Reload re-reads the CA bundle and key pair when the files change.
+	Reload bool `yaml:"reload"`
+}
+
+// BGPConfig declares the BGP speaker the agent owns. With Enabled it runs
+// in-process instead of dialing gobgpd and the gobgp section is ignored;
+// with Manage the external gobgpd is converged to it over the API.
+type BGPConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Manage starts BGP on gobgpd if needed and adds, updates and deletes
+	// its neighbors, peer groups and dynamic neighbors to match this
+	// section. Peers not declared here are removed.
+	Manage bool   `yaml:"manage"`
+	ASN    uint32 `yaml:"asn"`
+	// RouterID defaults to node.routerId, then the local IPv4 address.
+	RouterID string `yaml:"routerId"`
+	// ListenPort defaults to 179; -1 disables the listener (outbound only).
+	ListenPort      int32    `yaml:"listenPort"`
+	ListenAddresses []string `yaml:"listenAddresses"`
+	// ClusterID is sent to route-reflector clients; defaults to the router id.
+	ClusterID        string               `yaml:"clusterId"`
+	PeerGroups       []BGPPeerGroup       `yaml:"peerGroups"`
+	Neighbors        []BGPNeighbor        `yaml:"neighbors"`
+	DynamicNeighbors []BGPDynamicNeighbor `yaml:"dynamicNeighbors"`
+}
+
+// BGPPeerGroup holds settings shared by its neighbors and dynamic neighbors.
+type BGPPeerGroup struct {
+	Name        string `yaml:"name"`
+	PeerASN     uint32 `yaml:"peerAsn"`
+	MultihopTTL uint32 `yaml:"multihopTtl"`
+	RRClient    bool   `yaml:"routeReflectorClient"`
+}
+
+// BGPNeighbor is a statically configured peer. Unset fields are inherited
+// from PeerGroup.
+type BGPNeighbor struct {
+	Address     string `yaml:"address"`
+	PeerASN     uint32 `yaml:"peerAsn"`
+	PeerGroup   string `yaml:"peerGroup"`
+	MultihopTTL uint32 `yaml:"multihopTtl"`
+	RRClient    bool   `yaml:"routeReflectorClient"`
+}
+
+// BGPDynamicNeighbor accepts sessions from any address in Prefix into
+// PeerGroup.
+type BGPDynamicNeighbor struct {
+	Prefix    string `yaml:"prefix"`
+	PeerGroup string `yaml:"peerGroup"`
+}
+
+// ImportPolicy decides which received paths may add remote state. Every
+// set condition must hold; an empty policy accepts everything.
+type ImportPolicy struct {
+	// AllowedVTEPs lists the CIDRs remote VTEP addresses must fall in.
+	AllowedVTEPs []string `yaml:"allowedVteps"`
+	// RequiredCommunities must all be present; DeniedCommunities reject the
+	// path if any is present. Values are standard (ASN:VALUE), large
+	// (A:B:C) or route-target communities.
+	RequiredCommunities []string `yaml:"requiredCommunities"`
+	DeniedCommunities   []string `yaml:"deniedCommunities"`
+	// OriginASNs restricts the last AS of the AS path. Paths with an empty
+	// AS path originate in the local AS and pass.
+	OriginASNs []uint32 `yaml:"originAsns"`
+	// ASPathRegex is matched against the AS path as space-separated ASNs.
+	ASPathRegex string `yaml:"asPathRegex"`
+	// MaxVTEPsPerVNI caps the remote VTEPs of a VNI; 0 means no limit.
+	MaxVTEPsPerVNI int `yaml:"maxVtepsPerVni"`
+}
+
+// GRConfig retains programmed remote entries across a loss of the gobgpd
+// session for StaleTime, in the spirit of BGP graceful restart.
+type GRConfig struct {
+	Enabled   bool          `yaml:"enabled"`
+	StaleTime time.Duration `yaml:"staleTime"`
+}
+
+// Dampening suppresses flapping VNI memberships in the manner of RFC 2439.
+// Each withdrawal adds Penalty; the penalty halves every HalfLife. Above
+// SuppressThreshold the membership is held back until the penalty decays
+// below ReuseThreshold, and never longer than MaxSuppressTime.
+type Dampening struct {
+	Enabled           bool          `yaml:"enabled"`
+	Penalty           float64       `yaml:"penalty"`
+	SuppressThreshold float64       `yaml:"suppressThreshold"`
+	ReuseThreshold    float64       `yaml:"reuseThreshold"`
+	HalfLife          time.Duration `yaml:"halfLife"`
+	MaxSuppressTime   time.Duration `yaml:"maxSuppressTime"`
+}
+
+// TunnelEncap announces the local VTEP's capabilities in an RFC 9012
+// Tunnel Encapsulation attribute on membership routes: the VXLAN tunnel
+// type, node.vxlanPort as UDP destination port and MTU when set.
+type TunnelEncap struct {
+	Advertise bool   `yaml:"advertise"`
+	MTU       uint16 `yaml:"mtu"`
 }
 
 // NodeConfig defines local interface settings.
 type NodeConfig struct {
-	LocalAddress      string `yaml:"localAddress"`
-	LocalInterface    string `yaml:"localInterface"`
-	VXLANPort         uint16 `yaml:"vxlanPort"`
-	SkipLinkCleanup   bool   `yaml:"skipLinkCleanup"`
-	AutoRecreateVxlan bool   `yaml:"autoRecreateVxlan"`
+	LocalAddress      string        `yaml:"localAddress"`
+	LocalInterface    string        `yaml:"localInterface"`
+	AddressFamily     string        `yaml:"addressFamily"`
+	RouterID          string        `yaml:"routerId"`
+	VXLANPort         uint16        `yaml:"vxlanPort"`
+	SkipLinkCleanup   bool          `yaml:"skipLinkCleanup"`
+	AutoRecreateVxlan bool          `yaml:"autoRecreateVxlan"`
+	CreateVxlan       bool          `yaml:"createVxlan"`
+	CleanupPolicy     string        `yaml:"cleanupPolicy"`
+	ResyncInterval    time.Duration `yaml:"resyncInterval"`
+	ReconcileWorkers  int           `yaml:"reconcileWorkers"`
+	RepairMode        string        `yaml:"repairMode"`
 }
 
 // VNIConfig represents a single overlay instance.
 type VNIConfig struct {
 	ID                uint32 `yaml:"id"`
 	Community         string `yaml:"community"`
+	RD                string `yaml:"rd"`
+	RouteTarget       string `yaml:"routeTarget"`
 	Device            string `yaml:"device"`
 	UnderlayInterface string `yaml:"underlayInterface"`
+	MTU               int    `yaml:"mtu"`
+	ARPSuppress       bool   `yaml:"arpSuppress"`
+}
+
+// L3VNIConfig binds a Linux VRF to an L3 VNI for symmetric IRB: prefixes
+// of the VRF are exchanged as EVPN Type-5 routes over the L3 VXLAN device.
+type L3VNIConfig struct {
+	ID          uint32 `yaml:"id"`
+	VRF         string `yaml:"vrf"`
+	Device      string `yaml:"device"`
+	SVI         string `yaml:"svi"`
+	RD          string `yaml:"rd"`
+	RouteTarget string `yaml:"routeTarget"`
 }
 
 // Load reads configuration from a YAML file and applies defaults.
@@ -65,23 +298,89 @@ func applyDefaults(cfg *Config) {
 	if cfg.LogLevel == "" {
 		cfg.LogLevel = "info"
 	}
-	if cfg.GoBGP.Address == "" {
+	if cfg.Mode == "" {
+		cfg.Mode = ModeCommunity
+	}
+	if cfg.CommunityEncoding == "" {
+		cfg.CommunityEncoding = EncodingStandard
+	}
+	if cfg.VTEPSource == "" {
+		cfg.VTEPSource = VTEPSourcePrefix
+	}
+	if cfg.MembershipAdvertisement == "" {
+		cfg.MembershipAdvertisement = AdvertiseAggregate
+	}
+	if cfg.MembershipPaths == "" {
+		cfg.MembershipPaths = MembershipBest
+	}
+	if cfg.Node.CleanupPolicy == "" {
+		// skipLinkCleanup predates the cleanup policies.
+		cfg.Node.CleanupPolicy = CleanupDeleteOwned
+		if cfg.Node.SkipLinkCleanup {
+			cfg.Node.CleanupPolicy = CleanupNone
+		}
+	}
+	if cfg.Node.RepairMode == "" {
+		cfg.Node.RepairMode = RepairReport
+	}
+	if cfg.GoBGP.Address == "" && len(cfg.GoBGP.Endpoints) == 0 {
 		cfg.GoBGP.Address = "127.0.0.1:50051"
 	}
+	if len(cfg.GoBGP.Endpoints) == 0 {
+		cfg.GoBGP.Endpoints = []string{cfg.GoBGP.Address}
+	}
 	if cfg.GoBGP.Timeout == 0 {
 		cfg.GoBGP.Timeout = 5 * time.Second
 	}
+	if cfg.BGP.ListenPort == 0 {
+		cfg.BGP.ListenPort = 179
+	}
+	if cfg.GracefulRestart.StaleTime == 0 {
+		cfg.GracefulRestart.StaleTime = 120 * time.Second
+	}
+	if cfg.Dampening.Penalty == 0 {
+		cfg.Dampening.Penalty = 1000
+	}
+	if cfg.Dampening.SuppressThreshold == 0 {
+		cfg.Dampening.SuppressThreshold = 2000
+	}
+	if cfg.Dampening.ReuseThreshold == 0 {
+		cfg.Dampening.ReuseThreshold = 750
+	}
+	if cfg.Dampening.HalfLife == 0 {
+		cfg.Dampening.HalfLife = 15 * time.Minute
+	}
+	if cfg.Dampening.MaxSuppressTime == 0 {
+		cfg.Dampening.MaxSuppressTime = 4 * cfg.Dampening.HalfLife
+	}
 	if cfg.CommunityASN == 0 {
 		cfg.CommunityASN = 0
 	}
 	if cfg.Node.LocalInterface == "" {
 		cfg.Node.LocalInterface = "eth0"
 	}
+	if cfg.Node.AddressFamily == "" {
+		cfg.Node.AddressFamily = FamilyIPv4
+	}
 	if cfg.Node.VXLANPort == 0 {
 		cfg.Node.VXLANPort = 4789
 	}
-	// Do not auto-recreate vxlan by default (deletion is treated as withdrawal).
-	// AutoRecreateVxlan defaults to false.
+	if cfg.Node.ResyncInterval == 0 {
+		cfg.Node.ResyncInterval = time.Minute
+	}
+	if cfg.Node.ReconcileWorkers == 0 {
+		cfg.Node.ReconcileWorkers = 1
+	}
+	for i := range cfg.L3VNIs {
+		if cfg.L3VNIs[i].Device == "" {
+			cfg.L3VNIs[i].Device = fmt.Sprintf("vxlan%d", cfg.L3VNIs[i].ID)
+		}
+		if cfg.L3VNIs[i].RouteTarget == "" && cfg.CommunityASN != 0 {
+			cfg.L3VNIs[i].RouteTarget = fmt.Sprintf("%d:%d", cfg.CommunityASN, cfg.L3VNIs[i].ID)
+		}
+	}
+	// Do not create or recreate vxlan by default (deletion is treated as
+	// withdrawal). CreateVxlan and AutoRecreateVxlan default to false.
 	// Keep VNIs empty unless explicitly configured.
 	for i := range cfg.VNIs {
 		if cfg.VNIs[i].Device == "" {
@@ -91,13 +390,106 @@ func applyDefaults(cfg *Config) {
 			cfg.VNIs[i].UnderlayInterface = cfg.Node.LocalInterface
 		}
 		if cfg.VNIs[i].Community == "" && cfg.CommunityASN != 0 {
-			cfg.VNIs[i].Community = fmt.Sprintf("%d:%d", cfg.CommunityASN, cfg.VNIs[i].ID)
+			cfg.VNIs[i].Community = cfg.DefaultCommunity(cfg.VNIs[i].ID)
+		}
+		if cfg.VNIs[i].RouteTarget == "" && cfg.CommunityASN != 0 {
+			cfg.VNIs[i].RouteTarget = fmt.Sprintf("%d:%d", cfg.CommunityASN, cfg.VNIs[i].ID)
 		}
 	}
 }
 
 // Validate performs basic sanity checks.
 func (c *Config) Validate() error {
+	switch c.Mode {
+	case ModeCommunity, ModeEVPN:
+	default:
+		return fmt.Errorf("mode must be %q or %q", ModeCommunity, ModeEVPN)
+	}
+	switch c.CommunityEncoding {
+	case EncodingStandard, EncodingLarge, EncodingExtended:
+	default:
+		return fmt.Errorf("communityEncoding must be %q, %q or %q", EncodingStandard, EncodingLarge, EncodingExtended)
+	}
+	switch c.VTEPSource {
+	case VTEPSourcePrefix:
+	case VTEPSourceNextHop, VTEPSourceTunnelEncap:
+		if c.Mode != ModeCommunity {
+			return fmt.Errorf("vtepSource %q requires mode %q", c.VTEPSource, ModeCommunity)
+		}
+	default:
+		return fmt.Errorf("vtepSource must be %q, %q or %q", VTEPSourcePrefix, VTEPSourceNextHop, VTEPSourceTunnelEncap)
+	}
+	switch c.MembershipAdvertisement {
+	case AdvertiseAggregate:
+	case AdvertisePerVNI:
+		if c.Mode != ModeCommunity {
+			return fmt.Errorf("membershipAdvertisement %q requires mode %q", AdvertisePerVNI, ModeCommunity)
+		}
+	default:
+		return fmt.Errorf("membershipAdvertisement must be %q or %q", AdvertiseAggregate, AdvertisePerVNI)
+	}
+	switch c.MembershipPaths {
+	case MembershipBest, MembershipAll:
+	default:
+		return fmt.Errorf("membershipPaths must be %q or %q", MembershipBest, MembershipAll)
+	}
+	if c.Node.ResyncInterval < 0 {
+		return fmt.Errorf("node.resyncInterval must not be negative")
+	}
+	if c.Node.ReconcileWorkers < 0 {
+		return fmt.Errorf("node.reconcileWorkers must not be negative")
+	}
+	switch c.Node.CleanupPolicy {
+	case CleanupDeleteOwned, CleanupFlushFDB, CleanupNone:
+	default:
+		return fmt.Errorf("node.cleanupPolicy must be %q, %q or %q", CleanupDeleteOwned, CleanupFlushFDB, CleanupNone)
+	}
+	switch c.Node.RepairMode {
+	case RepairReport, RepairRecreateOwned, RepairRecreate:
+	default:
+		return fmt.Errorf("node.repairMode must be %q, %q or %q", RepairReport, RepairRecreateOwned, RepairRecreate)
+	}
+	switch c.Node.AddressFamily {
+	case FamilyIPv4, FamilyIPv6:
+	default:
+		return fmt.Errorf("node.addressFamily must be %q or %q", FamilyIPv4, FamilyIPv6)
+	}
+	seenEndpoints := make(map[string]struct{}, len(c.GoBGP.Endpoints))
+	for _, ep := range c.GoBGP.Endpoints {
+		if _, dup := seenEndpoints[ep]; dup || ep == "" {
+			return fmt.Errorf("gobgp.endpoints must be unique and non-empty")
+		}
+		seenEndpoints[ep] = struct{}{}
+	}
+	if err := c.GoBGP.TLS.validate(); err != nil {
+		return err
+	}
+	if err := c.Dampening.validate(); err != nil {
+		return err
+	}
+	if err := c.ImportPolicy.validate(); err != nil {
+		return err
+	}
+	if err := c.BGP.validate(); err != nil {
+		return err
+	}
+	if c.Node.LocalAddress != "" && net.ParseIP(c.Node.LocalAddress) == nil {
+		return fmt.Errorf("node.localAddress must be an IP address when set")
+	}
+	if c.Node.RouterID != "" {
+		if ip := net.ParseIP(c.Node.RouterID); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("node.routerId must be IPv4 when set")
+		}
+	}
+	if c.MACAdvertisement && c.Mode != ModeEVPN {
+		return fmt.Errorf("macAdvertisement requires mode %q", ModeEVPN)
+	}
+	if err := c.validateL3VNIs(); err != nil {
+		return err
+	}
+	if err := c.validateAutoRDs(); err != nil {
+		return err
+	}
 	if len(c.VNIs) == 0 {
 		if c.CommunityASN == 0 {
 			return fmt.Errorf("at least one VNI must be configured or communityAsn must be set")
@@ -108,24 +500,234 @@ func (c *Config) Validate() error {
 		if v.ID == 0 {
 			return fmt.Errorf("vni id must be > 0")
 		}
+		if v.ID > 0xffffff {
+			return fmt.Errorf("vni %d exceeds 24 bits", v.ID)
+		}
+		if v.RD != "" {
+			if _, err := apibgp.ParseRouteDistinguisher(v.RD); err != nil {
+				return fmt.Errorf("vni %d invalid rd %q: %w", v.ID, v.RD, err)
+			}
+		}
+		if v.MTU != 0 && (v.MTU < 68 || v.MTU > 65535) {
+			return fmt.Errorf("vni %d mtu must be between 68 and 65535", v.ID)
+		}
+		if v.ARPSuppress && c.Mode != ModeEVPN {
+			return fmt.Errorf("vni %d arpSuppress requires mode %q", v.ID, ModeEVPN)
+		}
+		if c.Mode == ModeEVPN {
+			if v.RouteTarget == "" {
+				return fmt.Errorf("vni %d missing routeTarget and communityAsn not set", v.ID)
+			}
+			if _, err := ParseRouteTarget(v.RouteTarget); err != nil {
+				return fmt.Errorf("vni %d invalid routeTarget %q: %w", v.ID, v.RouteTarget, err)
+			}
+			continue
+		}
 		if v.Community == "" {
 			if c.CommunityASN == 0 {
 				return fmt.Errorf("vni %d missing community and communityAsn not set", v.ID)
 			}
 			continue
 		}
-		if _, err := ParseCommunity(v.Community); err != nil {
+		if _, err := ParseMembership(c.CommunityEncoding, v.Community); err != nil {
 			return fmt.Errorf("vni %d invalid community %q: %w", v.ID, v.Community, err)
 		}
 	}
-	if c.Node.LocalAddress != "" {
-		if ip := net.ParseIP(c.Node.LocalAddress); ip == nil || ip.To4() == nil {
-			return fmt.Errorf("node.localAddress must be IPv4 when set")
+	return nil
+}
+
+func (t TLSConfig) validate() error {
+	if !t.Enabled {
+		if t.CAFile != "" || t.CertFile != "" || t.KeyFile != "" || t.ServerName != "" {
+			return fmt.Errorf("gobgp.tls options set but gobgp.tls.enabled is false")
 		}
+		return nil
+	}
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return fmt.Errorf("gobgp.tls.certFile and gobgp.tls.keyFile must be set together")
 	}
 	return nil
 }
 
+func (d Dampening) validate() error {
+	if !d.Enabled {
+		return nil
+	}
+	if d.Penalty <= 0 || d.ReuseThreshold <= 0 {
+		return fmt.Errorf("dampening.penalty and dampening.reuseThreshold must be positive")
+	}
+	if d.SuppressThreshold <= d.ReuseThreshold {
+		return fmt.Errorf("dampening.suppressThreshold must be above dampening.reuseThreshold")
+	}
+	if d.HalfLife <= 0 || d.MaxSuppressTime <= 0 {
+		return fmt.Errorf("dampening.halfLife and dampening.maxSuppressTime must be positive")
+	}
+	// The penalty is capped so suppression ends within maxSuppressTime.
+	if d.ReuseThreshold*math.Exp2(float64(d.MaxSuppressTime)/float64(d.HalfLife)) <= d.SuppressThreshold {
+		return fmt.Errorf("dampening.maxSuppressTime is too short for the penalty to reach suppressThreshold")
+	}
+	return nil
+}
+
+func (p ImportPolicy) validate() error {
+	for _, cidr := range p.AllowedVTEPs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("importPolicy.allowedVteps %q: %w", cidr, err)
+		}
+	}
+	for _, c := range append(append([]string(nil), p.RequiredCommunities...), p.DeniedCommunities...) {
+		if _, err := ParsePolicyCommunity(c); err != nil {
+			return fmt.Errorf("importPolicy community %q: %w", c, err)
+		}
+	}
+	if _, err := regexp.Compile(p.ASPathRegex); err != nil {
+		return fmt.Errorf("importPolicy.asPathRegex: %w", err)
+	}
+	if p.MaxVTEPsPerVNI < 0 {
+		return fmt.Errorf("importPolicy.maxVtepsPerVni must not be negative")
+	}
+	return nil
+}
+
+func (b BGPConfig) validate() error {
+	if !b.Enabled && !b.Manage {
+		return nil
+	}
+	if b.ASN == 0 {
+		return fmt.Errorf("bgp.asn is required when bgp.enabled or bgp.manage is true")
+	}
+	for name, raw := range map[string]string{"routerId": b.RouterID, "clusterId": b.ClusterID} {
+		if raw == "" {
+			continue
+		}
+		if ip := net.ParseIP(raw); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("bgp.%s must be IPv4 when set", name)
+		}
+	}
+	for _, addr := range b.ListenAddresses {
+		if net.ParseIP(addr) == nil {
+			return fmt.Errorf("bgp.listenAddresses: invalid address %q", addr)
+		}
+	}
+	groups := make(map[string]BGPPeerGroup, len(b.PeerGroups))
+	for _, g := range b.PeerGroups {
+		if g.Name == "" {
+			return fmt.Errorf("bgp peer group name must be set")
+		}
+		if _, dup := groups[g.Name]; dup {
+			return fmt.Errorf("bgp peer group %q defined twice", g.Name)
+		}
+		groups[g.Name] = g
+	}
+	seen := make(map[string]struct{}, len(b.Neighbors))
+	for _, n := range b.Neighbors {
+		ip := net.ParseIP(n.Address)
+		if ip == nil {
+			return fmt.Errorf("bgp neighbor %q: address must be an IP", n.Address)
+		}
+		if _, dup := seen[ip.String()]; dup {
+			return fmt.Errorf("bgp neighbor %s defined twice", n.Address)
+		}
+		seen[ip.String()] = struct{}{}
+		g, ok := groups[n.PeerGroup]
+		if n.PeerGroup != "" && !ok {
+			return fmt.Errorf("bgp neighbor %s: unknown peer group %q", n.Address, n.PeerGroup)
+		}
+		if n.PeerASN == 0 && g.PeerASN == 0 {
+			return fmt.Errorf("bgp neighbor %s: peerAsn not set on neighbor or peer group", n.Address)
+		}
+	}
+	for _, d := range b.DynamicNeighbors {
+		if _, _, err := net.ParseCIDR(d.Prefix); err != nil {
+			return fmt.Errorf("bgp dynamic neighbor prefix %q: %w", d.Prefix, err)
+		}
+		g, ok := groups[d.PeerGroup]
+		if !ok {
+			return fmt.Errorf("bgp dynamic neighbor %s: unknown peer group %q", d.Prefix, d.PeerGroup)
+		}
+		if g.PeerASN == 0 {
+			return fmt.Errorf("bgp dynamic neighbor %s: peer group %q needs peerAsn", d.Prefix, d.PeerGroup)
+		}
+	}
+	return nil
+}
+
+func (c *Config) validateL3VNIs() error {
+	if len(c.L3VNIs) > 0 && c.Mode != ModeEVPN {
+		return fmt.Errorf("l3vnis require mode %q", ModeEVPN)
+	}
+	seen := make(map[uint32]struct{}, len(c.VNIs)+len(c.L3VNIs))
+	for _, v := range c.VNIs {
+		seen[v.ID] = struct{}{}
+	}
+	for _, v := range c.L3VNIs {
+		if v.ID == 0 || v.ID > 0xffffff {
+			return fmt.Errorf("l3vni id %d must be in 1..16777215", v.ID)
+		}
+		if _, dup := seen[v.ID]; dup {
+			return fmt.Errorf("l3vni %d collides with another vni", v.ID)
+		}
+		seen[v.ID] = struct{}{}
+		if v.VRF == "" || v.SVI == "" {
+			return fmt.Errorf("l3vni %d requires vrf and svi", v.ID)
+		}
+		if v.RD != "" {
+			if _, err := apibgp.ParseRouteDistinguisher(v.RD); err != nil {
+				return fmt.Errorf("l3vni %d invalid rd %q: %w", v.ID, v.RD, err)
+			}
+		}
+		if v.RouteTarget == "" {
+			return fmt.Errorf("l3vni %d missing routeTarget and communityAsn not set", v.ID)
+		}
+		if _, err := ParseRouteTarget(v.RouteTarget); err != nil {
+			return fmt.Errorf("l3vni %d invalid routeTarget %q: %w", v.ID, v.RouteTarget, err)
+		}
+	}
+	return nil
+}
+
+// validateAutoRDs rejects VNIs without an rd whose derived RDs would be
+// equal, as their routes would then replace each other.
+func (c *Config) validateAutoRDs() error {
+	taken := make(map[uint16]uint32, len(c.VNIs)+len(c.L3VNIs))
+	check := func(id uint32, rd string) error {
+		if rd != "" {
+			return nil
+		}
+		if other, ok := taken[AutoRDIndex(id)]; ok {
+			return fmt.Errorf("vni %d and vni %d derive the same rd <router-id>:%d; set rd on one of them", other, id, AutoRDIndex(id))
+		}
+		taken[AutoRDIndex(id)] = id
+		return nil
+	}
+	if c.UsesRD() {
+		for _, v := range c.VNIs {
+			if err := check(v.ID, v.RD); err != nil {
+				return err
+			}
+		}
+	}
+	for _, v := range c.L3VNIs {
+		if err := check(v.ID, v.RD); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UsesRD reports whether the VNIs are announced as EVPN routes, which need
+// a route distinguisher each.
+func (c *Config) UsesRD() bool {
+	return c.Mode == ModeEVPN || c.MembershipAdvertisement == AdvertisePerVNI
+}
+
+// AutoRDIndex returns the assigned number of the type 1 RD
+// <router-id>:<n> derived for a VNI without an rd. The field has 16 bits,
+// so it is the VNI's low 16 bits and VNIs 65536 apart share it.
+func AutoRDIndex(vni uint32) uint16 {
+	return uint16(vni & 0xffff)
+}
+
 // ParseCommunity parses "ASN:VALUE" into uint32.
 func ParseCommunity(raw string) (uint32, error) {
 	parts := strings.Split(raw, ":")
@@ -142,3 +744,92 @@ func ParseCommunity(raw string) (uint32, error) {
 	}
 	return uint32(asn<<16 | val), nil
 }
+
+// DefaultCommunity derives the membership community for a VNI from
+// communityAsn in the configured encoding.
+func (c *Config) DefaultCommunity(vni uint32) string {
+	if c.CommunityEncoding == EncodingLarge {
+		return fmt.Sprintf("%d:0:%d", c.CommunityASN, vni)
+	}
+	return fmt.Sprintf("%d:%d", c.CommunityASN, vni)
+}
+
+// ParseMembership validates a membership community in the given encoding
+// and returns its canonical string form, which is how paths are matched.
+func ParseMembership(encoding, raw string) (string, error) {
+	switch encoding {
+	case EncodingLarge:
+		lc, err := apibgp.ParseLargeCommunity(raw)
+		if err != nil {
+			return "", fmt.Errorf("format must be ASN:0:VALUE: %w", err)
+		}
+		return lc.String(), nil
+	case EncodingExtended:
+		rt, err := ParseRouteTarget(raw)
+		if err != nil {
+			return "", err
+		}
+		return rt.String(), nil
+	default:
+		val, err := ParseCommunity(raw)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%d:%d", val>>16, val&0xffff), nil
+	}
+}
+
+// ParsePolicyCommunity parses an importPolicy community: standard
+// (ASN:VALUE), large (A:B:C) or route target (ASN:VALUE or IP:VALUE). It
+// returns the string form path communities are compared in.
+func ParsePolicyCommunity(raw string) (string, error) {
+	if strings.Count(raw, ":") == 2 {
+		lc, err := apibgp.ParseLargeCommunity(raw)
+		if err != nil {
+			return "", fmt.Errorf("large community: %w", err)
+		}
+		return lc.String(), nil
+	}
+	if val, err := ParseCommunity(raw); err == nil {
+		return fmt.Sprintf("%d:%d", val>>16, val&0xffff), nil
+	}
+	rt, err := ParseRouteTarget(raw)
+	if err != nil {
+		return "", fmt.Errorf("must be ASN:VALUE, A:B:C or a route target: %w", err)
+	}
+	return rt.String(), nil
+}
+
+// ParseRouteTarget parses "ASN:VALUE" or "IP:VALUE" into a route-target
+// extended community. A 2-byte ASN allows a 32-bit value; a 4-byte ASN or
+// IPv4 administrator leaves 16 bits for the value.
+func ParseRouteTarget(raw string) (apibgp.ExtendedCommunityInterface, error) {
+	i := strings.LastIndex(raw, ":")
+	if i <= 0 {
+		return nil, fmt.Errorf("format must be ASN:VALUE or IP:VALUE")
+	}
+	admin, value := raw[:i], raw[i+1:]
+	if ip := net.ParseIP(admin); ip != nil && ip.To4() != nil {
+		val, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("value: %w", err)
+		}
+		return apibgp.NewIPv4AddressSpecificExtended(apibgp.EC_SUBTYPE_ROUTE_TARGET, admin, uint16(val), true), nil
+	}
+	asn, err := strconv.ParseUint(admin, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("asn: %w", err)
+	}
+	val, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("value: %w", err)
+	}
+	switch {
+	case asn <= 0xffff:
+		return apibgp.NewTwoOctetAsSpecificExtended(apibgp.EC_SUBTYPE_ROUTE_TARGET, uint16(asn), uint32(val), true), nil
+	case val <= 0xffff:
+		return apibgp.NewFourOctetAsSpecificExtended(apibgp.EC_SUBTYPE_ROUTE_TARGET, uint32(asn), uint16(val), true), nil
+	default:
+		return nil, fmt.Errorf("4-byte asn %d leaves only 16 bits for value %d", asn, val)
+	}
+}
@@ -0,0 +1,232 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func loadYAML(t *testing.T, doc string) (Config, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(doc), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return Load(path)
+}
+
+func TestAutoRDs(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     string
+		wantErr string
+	}{
+		{
+			name: "distinct low bits",
+			doc: `mode: evpn
+node: {localAddress: 10.0.0.1}
+vnis:
+  - {id: 1, routeTarget: "65000:1"}
+  - {id: 65538, routeTarget: "65000:65538"}
+`,
+		},
+		{
+			name: "24-bit vni collides with 16-bit vni",
+			doc: `mode: evpn
+node: {localAddress: 10.0.0.1}
+vnis:
+  - {id: 1, routeTarget: "65000:1"}
+  - {id: 65537, routeTarget: "65000:65537"}
+`,
+			wantErr: "vni 1 and vni 65537 derive the same rd",
+		},
+		{
+			name: "explicit rd resolves collision",
+			doc: `mode: evpn
+node: {localAddress: 10.0.0.1}
+vnis:
+  - {id: 1, routeTarget: "65000:1"}
+  - {id: 65537, routeTarget: "65000:65537", rd: "10.0.0.1:999"}
+`,
+		},
+		{
+			name: "l3vni collides with vni",
+			doc: `mode: evpn
+node: {localAddress: 10.0.0.1}
+vnis:
+  - {id: 5, routeTarget: "65000:5"}
+l3vnis:
+  - {id: 65541, vrf: red, svi: br-red, routeTarget: "65000:65541"}
+`,
+			wantErr: "vni 5 and vni 65541 derive the same rd",
+		},
+		{
+			name: "aggregate community mode uses no rds",
+			doc: `communityAsn: 65000
+communityEncoding: large
+node: {localAddress: 10.0.0.1}
+vnis:
+  - {id: 1}
+  - {id: 65537}
+`,
+		},
+		{
+			name: "per-vni community mode",
+			doc: `communityAsn: 65000
+communityEncoding: large
+membershipAdvertisement: perVni
+node: {localAddress: 10.0.0.1}
+vnis:
+  - {id: 1}
+  - {id: 65537}
+`,
+			wantErr: "derive the same rd",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadYAML(t, tt.doc)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseRouteTarget(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{raw: "65000:100", want: "65000:100"},
+		{raw: "65000:16777215", want: "65000:16777215"},
+		{raw: "65000:4294967295", want: "65000:4294967295"},
+		// GoBGP prints 4-byte ASNs in asdot notation.
+		{raw: "4200000000:100", want: "64086.59904:100"},
+		{raw: "4200000000:65535", want: "64086.59904:65535"},
+		{raw: "10.0.0.1:100", want: "10.0.0.1:100"},
+		{raw: "4200000000:65536", wantErr: true},
+		{raw: "10.0.0.1:65536", wantErr: true},
+		{raw: "65000:4294967296", wantErr: true},
+		{raw: "65000", wantErr: true},
+		{raw: ":100", wantErr: true},
+		{raw: "foo:bar", wantErr: true},
+		{raw: "2001:db8::1:100", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			rt, err := ParseRouteTarget(tt.raw)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("want error, got %v", rt)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := rt.String(); got != tt.want {
+				t.Fatalf("route target = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMembership(t *testing.T) {
+	tests := []struct {
+		encoding string
+		raw      string
+		want     string
+		wantErr  bool
+	}{
+		{encoding: EncodingStandard, raw: "65000:100", want: "65000:100"},
+		{encoding: EncodingStandard, raw: "65000:65535", want: "65000:65535"},
+		// A 24-bit VNI does not fit a standard community.
+		{encoding: EncodingStandard, raw: "65000:65536", wantErr: true},
+		{encoding: EncodingStandard, raw: "65536:1", wantErr: true},
+		{encoding: EncodingStandard, raw: "65000:0:100", wantErr: true},
+		{encoding: EncodingLarge, raw: "65000:0:16777215", want: "65000:0:16777215"},
+		{encoding: EncodingLarge, raw: "4200000000:0:100", want: "4200000000:0:100"},
+		{encoding: EncodingLarge, raw: "65000:100", wantErr: true},
+		{encoding: EncodingExtended, raw: "65000:16777215", want: "65000:16777215"},
+		{encoding: EncodingExtended, raw: "foo:1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.encoding+"/"+tt.raw, func(t *testing.T) {
+			got, err := ParseMembership(tt.encoding, tt.raw)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("want error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("membership = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDefaultCommunity(t *testing.T) {
+	tests := []struct {
+		encoding string
+		vni      uint32
+		want     string
+	}{
+		{EncodingStandard, 100, "65000:100"},
+		{EncodingExtended, 16777215, "65000:16777215"},
+		{EncodingLarge, 16777215, "65000:0:16777215"},
+	}
+	for _, tt := range tests {
+		c := Config{CommunityASN: 65000, CommunityEncoding: tt.encoding}
+		if got := c.DefaultCommunity(tt.vni); got != tt.want {
+			t.Errorf("%s vni %d: community = %q, want %q", tt.encoding, tt.vni, got, tt.want)
+		}
+	}
+}
+
+func TestParsePolicyCommunity(t *testing.T) {
+	tests := []struct {
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{raw: "65000:100", want: "65000:100"},
+		{raw: "65000:0:100", want: "65000:0:100"},
+		{raw: "4200000000:1:2", want: "4200000000:1:2"},
+		// Too large for a standard community, valid as a route target.
+		{raw: "65000:16777215", want: "65000:16777215"},
+		{raw: "10.0.0.1:7", want: "10.0.0.1:7"},
+		{raw: "4200000000:7", want: "64086.59904:7"},
+		{raw: "foo:bar", wantErr: true},
+		{raw: "65000", wantErr: true},
+		{raw: "65000:x:1", wantErr: true},
+		{raw: "1:2:3:4", wantErr: true},
+		{raw: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			got, err := ParsePolicyCommunity(tt.raw)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("want error, got %q", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("community = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
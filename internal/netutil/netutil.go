@@ -24,3 +24,24 @@ func IPv4ForInterface(name string) (net.IP, error) {
 	}
 	return nil, fmt.Errorf("no IPv4 found on interface %s", name)
 }
+
+// IPv6ForInterface returns the first global unicast IPv6 address on the
+// given interface.
+func IPv6ForInterface(name string) (net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("lookup interface %s: %w", name, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("list addresses for %s: %w", name, err)
+	}
+	for _, addr := range addrs {
+		if ip, ok := addr.(*net.IPNet); ok {
+			if ip.IP.To4() == nil && ip.IP.IsGlobalUnicast() {
+				return ip.IP, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("no global IPv6 found on interface %s", name)
+}
@@ -0,0 +1,138 @@
+package tlsutil
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"gobgp-evpn-agent/internal/config"
+)
+
+// ClientConfig builds the TLS configuration used to dial gobgpd. The server
+// certificate is always verified, against the CA bundle when one is set and
+// the system roots otherwise. With Reload the CA bundle and client key pair
+// are re-read on the next handshake after their files change. serverName
+// is the name (or IP) the server certificate must be valid for.
+func ClientConfig(cfg config.TLSConfig, serverName string) (*tls.Config, error) {
+	s := &store{cfg: cfg, serverName: serverName}
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+	tc := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: serverName,
+	}
+	if cfg.CertFile != "" {
+		tc.GetClientCertificate = s.clientCertificate
+	}
+	if !cfg.Reload {
+		tc.RootCAs = s.pool
+		return tc, nil
+	}
+	// Verification is done in VerifyConnection so a rotated CA bundle is
+	// picked up without rebuilding the connection's tls.Config.
+	tc.InsecureSkipVerify = true
+	tc.VerifyConnection = s.verify
+	return tc, nil
+}
+
+type store struct {
+	cfg        config.TLSConfig
+	serverName string
+
+	mu      sync.Mutex
+	modTime map[string]time.Time
+	pool    *x509.CertPool
+	cert    *tls.Certificate
+}
+
+// refresh re-reads the CA bundle and key pair when any of their files
+// changed since the last load.
+func (s *store) refresh() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := s.modTime == nil
+	mod := make(map[string]time.Time, 3)
+	for _, path := range []string{s.cfg.CAFile, s.cfg.CertFile, s.cfg.KeyFile} {
+		if path == "" {
+			continue
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("stat %s: %w", path, err)
+		}
+		mod[path] = fi.ModTime()
+		if !fi.ModTime().Equal(s.modTime[path]) {
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	var pool *x509.CertPool
+	if s.cfg.CAFile != "" {
+		pem, err := os.ReadFile(s.cfg.CAFile)
+		if err != nil {
+			return fmt.Errorf("read ca bundle: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", s.cfg.CAFile)
+		}
+	}
+	var cert *tls.Certificate
+	if s.cfg.CertFile != "" {
+		pair, err := tls.LoadX509KeyPair(s.cfg.CertFile, s.cfg.KeyFile)
+		if err != nil {
+			return fmt.Errorf("load client key pair: %w", err)
+		}
+		cert = &pair
+	}
+	if s.modTime != nil {
+		slog.Info("reloaded gobgp tls material", "ca", s.cfg.CAFile, "cert", s.cfg.CertFile)
+	}
+	s.pool, s.cert, s.modTime = pool, cert, mod
+	return nil
+}
+
+func (s *store) reload() {
+	if !s.cfg.Reload {
+		return
+	}
+	// Keep using the previous material if a rotation is half-written.
+	if err := s.refresh(); err != nil {
+		slog.Warn("reload gobgp tls material failed", "err", err)
+	}
+}
+
+func (s *store) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	s.reload()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cert, nil
+}
+
+func (s *store) verify(cs tls.ConnectionState) error {
+	s.reload()
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("gobgp server presented no certificate")
+	}
+	s.mu.Lock()
+	pool := s.pool
+	s.mu.Unlock()
+	opts := x509.VerifyOptions{
+		Roots:         pool,
+		DNSName:       s.serverName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, c := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
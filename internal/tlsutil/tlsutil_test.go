@@ -0,0 +1,297 @@
+package tlsutil
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gobgp-evpn-agent/internal/config"
+)
+
+// testCA is a certificate authority issuing leaf certificates for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+var serial int64
+
+func newKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func newCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key := newKey(t)
+	serial++
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a PEM certificate and key for cn, valid for the DNS names
+// and IPs in hosts.
+func (ca *testCA) issue(t *testing.T, cn string, hosts ...string) ([]byte, []byte, tls.Certificate) {
+	t.Helper()
+	key := newKey(t)
+	serial++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	pair, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certPEM, keyPEM, pair
+}
+
+// writeFile writes data to path and moves its modification time forward,
+// so a rewrite within the file system's timestamp granularity is seen.
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	var mod time.Time
+	if fi, err := os.Stat(path); err == nil {
+		mod = fi.ModTime().Add(time.Second)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if !mod.IsZero() {
+		if err := os.Chtimes(path, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// handshake connects a client using tc to a server presenting cert and
+// returns the common name of the client certificate the server saw, if
+// any, and the client's handshake error.
+func handshake(t *testing.T, tc *tls.Config, cert tls.Certificate) (string, error) {
+	t.Helper()
+	cliConn, srvConn := net.Pipe()
+	srv := tls.Server(srvConn, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequestClientCert,
+	})
+	peer := make(chan string, 1)
+	go func() {
+		defer srvConn.Close()
+		var cn string
+		if err := srv.Handshake(); err == nil {
+			if certs := srv.ConnectionState().PeerCertificates; len(certs) > 0 {
+				cn = certs[0].Subject.CommonName
+			}
+		}
+		peer <- cn
+	}()
+	cli := tls.Client(cliConn, tc)
+	err := cli.Handshake()
+	cliConn.Close()
+	return <-peer, err
+}
+
+func TestClientConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca := newCA(t, "ca")
+	certPEM, keyPEM, _ := ca.issue(t, "agent")
+	files := map[string][]byte{
+		"ca.crt":     ca.pem,
+		"client.crt": certPEM,
+		"client.key": keyPEM,
+		"bad.crt":    []byte("not a certificate"),
+	}
+	for name, data := range files {
+		writeFile(t, filepath.Join(dir, name), data)
+	}
+	path := func(name string) string {
+		if name == "" {
+			return ""
+		}
+		return filepath.Join(dir, name)
+	}
+	tests := []struct {
+		name           string
+		ca, cert, key  string
+		reload         bool
+		wantErr        bool
+		wantClientCert bool
+	}{
+		{name: "system roots"},
+		{name: "ca bundle", ca: "ca.crt"},
+		{name: "client key pair", ca: "ca.crt", cert: "client.crt", key: "client.key", wantClientCert: true},
+		{name: "reload", ca: "ca.crt", cert: "client.crt", key: "client.key", reload: true, wantClientCert: true},
+		{name: "missing ca", ca: "missing.crt", wantErr: true},
+		{name: "ca without certificates", ca: "bad.crt", wantErr: true},
+		{name: "cert without key", ca: "ca.crt", cert: "client.crt", wantErr: true},
+		{name: "key of other cert", ca: "ca.crt", cert: "client.crt", key: "ca.crt", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.TLSConfig{Enabled: true, CAFile: path(tt.ca), CertFile: path(tt.cert), KeyFile: path(tt.key), Reload: tt.reload}
+			tc, err := ClientConfig(cfg, "gobgp.test")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.ServerName != "gobgp.test" || tc.MinVersion != tls.VersionTLS12 {
+				t.Fatalf("server name %q, min version %x", tc.ServerName, tc.MinVersion)
+			}
+			if (tc.GetClientCertificate != nil) != tt.wantClientCert {
+				t.Fatalf("client certificate callback set = %v, want %v", tc.GetClientCertificate != nil, tt.wantClientCert)
+			}
+			if tt.reload != (tc.VerifyConnection != nil) || tt.reload != tc.InsecureSkipVerify {
+				t.Fatalf("reload %v: VerifyConnection set %v, InsecureSkipVerify %v", tt.reload, tc.VerifyConnection != nil, tc.InsecureSkipVerify)
+			}
+			if !tt.reload && (tc.RootCAs != nil) != (tt.ca != "") {
+				t.Fatalf("RootCAs set = %v with ca %q", tc.RootCAs != nil, tt.ca)
+			}
+		})
+	}
+}
+
+func TestClientConfigHandshake(t *testing.T) {
+	dir := t.TempDir()
+	ca, other := newCA(t, "ca"), newCA(t, "other")
+	caFile := filepath.Join(dir, "ca.crt")
+	writeFile(t, caFile, ca.pem)
+	_, _, byCA := ca.issue(t, "gobgpd", "gobgp.test", "192.0.2.1")
+	_, _, byOther := other.issue(t, "gobgpd", "gobgp.test")
+	tests := []struct {
+		name       string
+		serverName string
+		cert       tls.Certificate
+		wantErr    bool
+	}{
+		{name: "trusted by name", serverName: "gobgp.test", cert: byCA},
+		{name: "trusted by ip", serverName: "192.0.2.1", cert: byCA},
+		{name: "wrong name", serverName: "other.test", cert: byCA, wantErr: true},
+		{name: "untrusted ca", serverName: "gobgp.test", cert: byOther, wantErr: true},
+	}
+	for _, reload := range []bool{false, true} {
+		for _, tt := range tests {
+			name := tt.name
+			if reload {
+				name += " with reload"
+			}
+			t.Run(name, func(t *testing.T) {
+				tc, err := ClientConfig(config.TLSConfig{Enabled: true, CAFile: caFile, Reload: reload}, tt.serverName)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = handshake(t, tc, tt.cert)
+				if tt.wantErr != (err != nil) {
+					t.Fatalf("handshake error %v, want error %v", err, tt.wantErr)
+				}
+			})
+		}
+	}
+}
+
+func TestClientConfigRotation(t *testing.T) {
+	dir := t.TempDir()
+	caOld, caNew := newCA(t, "old"), newCA(t, "new")
+	caFile := filepath.Join(dir, "ca.crt")
+	certFile := filepath.Join(dir, "client.crt")
+	keyFile := filepath.Join(dir, "client.key")
+	writeFile(t, caFile, caOld.pem)
+	certPEM, keyPEM, _ := caOld.issue(t, "agent-1")
+	writeFile(t, certFile, certPEM)
+	writeFile(t, keyFile, keyPEM)
+	_, _, oldServer := caOld.issue(t, "gobgpd", "gobgp.test")
+	_, _, newServer := caNew.issue(t, "gobgpd", "gobgp.test")
+
+	for _, reload := range []bool{false, true} {
+		cfg := config.TLSConfig{Enabled: true, CAFile: caFile, CertFile: certFile, KeyFile: keyFile, Reload: reload}
+		// Every case starts from the old material.
+		writeFile(t, caFile, caOld.pem)
+		writeFile(t, certFile, certPEM)
+		writeFile(t, keyFile, keyPEM)
+		tc, err := ClientConfig(cfg, "gobgp.test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cn, err := handshake(t, tc, oldServer); err != nil || cn != "agent-1" {
+			t.Fatalf("reload %v: before rotation: err %v, client %q", reload, err, cn)
+		}
+
+		// Rotate the CA and client key pair in place; the same tls.Config
+		// follows only with reload.
+		writeFile(t, caFile, append(append([]byte(nil), caNew.pem...), caOld.pem...))
+		rotCert, rotKey, _ := caNew.issue(t, "agent-2")
+		writeFile(t, certFile, rotCert)
+		writeFile(t, keyFile, rotKey)
+		cn, err := handshake(t, tc, newServer)
+		switch {
+		case reload && (err != nil || cn != "agent-2"):
+			t.Fatalf("reload: after rotation: err %v, client %q, want agent-2", err, cn)
+		case !reload && err == nil:
+			t.Fatal("without reload the rotated ca must not be trusted")
+		}
+
+		// A half-written rotation keeps the last good material.
+		if reload {
+			writeFile(t, keyFile, []byte("partial"))
+			if cn, err := handshake(t, tc, newServer); err != nil || cn != "agent-2" {
+				t.Fatalf("half-written rotation: err %v, client %q, want agent-2", err, cn)
+			}
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package vxlan
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// Endpoint is a remote VTEP address and the UDP port it receives VXLAN on.
+// A zero Port means the device's destination port.
+type Endpoint struct {
+	IP   string
+	Port uint16
+}
+
+// fdbEntry is an FDB entry of the device including its UDP port, which
+// netlink.Neigh does not carry.
+type fdbEntry struct {
+	mac   net.HardwareAddr
+	dst   net.IP
+	port  uint16
+	state uint16
+	flags uint8
+}
+
+// listFDB dumps the bridge FDB entries of the device. The kernel reports a
+// port only when it differs from the device's destination port.
+func (m *Manager) listFDB() ([]fdbEntry, error) {
+	if m.link == nil {
+		return nil, errors.New("vxlan link not ready")
+	}
+	index := uint32(m.link.Attrs().Index)
+	req := nl.NewNetlinkRequest(unix.RTM_GETNEIGH, unix.NLM_F_DUMP)
+	req.AddData(&netlink.Ndmsg{Family: unix.AF_BRIDGE, Index: index})
+	msgs, err := req.Execute(unix.NETLINK_ROUTE, unix.RTM_NEWNEIGH)
+	if err != nil && !errors.Is(err, netlink.ErrDumpInterrupted) {
+		return nil, fmt.Errorf("list fdb: %w", err)
+	}
+	var res []fdbEntry
+	for _, b := range msgs {
+		if len(b) < unix.SizeofNdMsg || nl.NativeEndian().Uint32(b[4:8]) != index {
+			continue
+		}
+		e := fdbEntry{state: nl.NativeEndian().Uint16(b[8:10]), flags: b[10]}
+		attrs, err := nl.ParseRouteAttr(b[unix.SizeofNdMsg:])
+		if err != nil {
+			continue
+		}
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case netlink.NDA_DST:
+				e.dst = net.IP(attr.Value)
+			case netlink.NDA_LLADDR:
+				e.mac = net.HardwareAddr(attr.Value)
+			case netlink.NDA_PORT:
+				if len(attr.Value) == 2 {
+					e.port = binary.BigEndian.Uint16(attr.Value)
+				}
+			}
+		}
+		res = append(res, e)
+	}
+	return res, nil
+}
+
+// writeFDB sends an FDB add (RTM_NEWNEIGH) or delete (RTM_DELNEIGH) for e on
+// the device.
+func (m *Manager) writeFDB(msgType, flags int, e fdbEntry) error {
+	req := nl.NewNetlinkRequest(msgType, flags|unix.NLM_F_ACK)
+	req.AddData(&netlink.Ndmsg{
+		Family: unix.AF_BRIDGE,
+		Index:  uint32(m.link.Attrs().Index),
+		State:  e.state,
+		Flags:  e.flags,
+	})
+	req.AddData(nl.NewRtAttr(netlink.NDA_LLADDR, []byte(e.mac)))
+	if e.dst != nil {
+		dst := e.dst.To4()
+		if dst == nil {
+			dst = e.dst.To16()
+		}
+		req.AddData(nl.NewRtAttr(netlink.NDA_DST, dst))
+	}
+	if e.port != 0 {
+		port := make([]byte, 2)
+		binary.BigEndian.PutUint16(port, e.port)
+		req.AddData(nl.NewRtAttr(netlink.NDA_PORT, port))
+	}
+	_, err := req.Execute(unix.NETLINK_ROUTE, 0)
+	return err
+}
+
+// fdbPort maps the device's own destination port to 0, matching how the
+// kernel reports entries.
+func (m *Manager) fdbPort(port uint16) uint16 {
+	if m.link != nil && int(port) == m.link.Port {
+		return 0
+	}
+	return port
+}
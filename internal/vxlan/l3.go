@@ -0,0 +1,327 @@
+package vxlan
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+
+	"gobgp-evpn-agent/internal/config"
+)
+
+const (
+	// routeProtocol tags kernel routes installed from remote Type-5 routes
+	// (RTPROT_BGP) so they are never re-advertised and can be swept.
+	routeProtocol = netlink.RouteProtocol(186)
+	rtnUnicast    = 1
+)
+
+// RemotePrefix is the forwarding information for a remote Type-5 prefix.
+type RemotePrefix struct {
+	VTEP      string
+	RouterMAC string
+}
+
+// L3Manager owns the kernel state of one L3 VNI: the VRF routing table, the
+// SVI neighbor entries for remote router MACs and the L3 VXLAN FDB.
+// Its exported methods are safe for concurrent use.
+type L3Manager struct {
+	// mu guards the cached handles and serializes kernel changes to the
+	// VRF.
+	mu    sync.Mutex
+	cfg   config.L3VNIConfig
+	vrf   *netlink.Vrf
+	vxlan *netlink.Vxlan
+	svi   netlink.Link
+	// ownedFDB (router MAC -> VTEP) and ownedNeigh (gateway -> router MAC)
+	// record the router FDB entries and SVI neighbors the agent programmed,
+	// or found already matching the desired state, so that sync removes
+	// nothing else.
+	ownedFDB   map[string]string
+	ownedNeigh map[string]string
+}
+
+func NewL3Manager(cfg config.L3VNIConfig) *L3Manager {
+	return &L3Manager{
+		cfg:        cfg,
+		ownedFDB:   make(map[string]string),
+		ownedNeigh: make(map[string]string),
+	}
+}
+
+// Load verifies the VRF, L3 VXLAN device and SVI exist and refreshes the
+// cached handles.
+func (m *L3Manager) Load() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.load()
+}
+
+func (m *L3Manager) load() error {
+	link, err := netlink.LinkByName(m.cfg.VRF)
+	if err != nil {
+		return err
+	}
+	vrf, ok := link.(*netlink.Vrf)
+	if !ok {
+		return fmt.Errorf("link %s exists but is not vrf", m.cfg.VRF)
+	}
+	link, err = netlink.LinkByName(m.cfg.Device)
+	if err != nil {
+		return err
+	}
+	vx, ok := link.(*netlink.Vxlan)
+	if !ok {
+		return fmt.Errorf("link %s exists but is not vxlan", m.cfg.Device)
+	}
+	svi, err := netlink.LinkByName(m.cfg.SVI)
+	if err != nil {
+		return err
+	}
+	m.vrf, m.vxlan, m.svi = vrf, vx, svi
+	return nil
+}
+
+// Involves reports whether an event on the interface index concerns the L3
+// VNI: it is the VRF, the L3 VXLAN device or the SVI.
+func (m *L3Manager) Involves(index int) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	vrf, vx, svi := m.vrf, m.vxlan, m.svi
+	if vrf == nil || vx == nil || svi == nil {
+		return false
+	}
+	return index == vrf.Attrs().Index || index == vx.Attrs().Index || index == svi.Attrs().Index
+}
+
+// Table returns the routing table of the VRF as last loaded, or 0.
+func (m *L3Manager) Table() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.vrf == nil {
+		return 0
+	}
+	return int(m.vrf.Table)
+}
+
+// RouterMAC returns the SVI MAC advertised in the router-MAC extended community.
+func (m *L3Manager) RouterMAC() net.HardwareAddr {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.svi == nil {
+		return nil
+	}
+	return m.svi.Attrs().HardwareAddr
+}
+
+// LocalPrefixes returns the connected and static unicast prefixes of the VRF,
+// excluding routes the agent installed itself.
+func (m *L3Manager) LocalPrefixes() ([]*net.IPNet, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Table: int(m.vrf.Table)}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, fmt.Errorf("list routes in vrf %s: %w", m.cfg.VRF, err)
+	}
+	var res []*net.IPNet
+	for _, r := range routes {
+		if r.Dst == nil || r.Type != rtnUnicast || r.Protocol == routeProtocol {
+			continue
+		}
+		if r.Dst.IP.IsLinkLocalUnicast() || r.Dst.IP.IsMulticast() {
+			continue
+		}
+		res = append(res, r.Dst)
+	}
+	return res, nil
+}
+
+// SyncRoutes converges the VRF to the desired prefix -> remote VTEP mapping
+// using symmetric IRB: a route via the VTEP (onlink over the SVI), a
+// neighbor entry resolving the VTEP to its router MAC, and an FDB entry
+// sending that MAC to the VTEP over the L3 VXLAN device. Only routes tagged
+// with the agent's protocol and neighbors and FDB entries it installed are
+// removed.
+func (m *L3Manager) SyncRoutes(desired map[string]RemotePrefix) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.load(); err != nil {
+		return err
+	}
+	routers := make(map[string]string) // gateway -> router MAC
+	fdb := make(map[string]string)     // router MAC -> VTEP
+	for prefix, r := range desired {
+		_, dst, err := net.ParseCIDR(prefix)
+		if err != nil {
+			return fmt.Errorf("invalid prefix %q: %w", prefix, err)
+		}
+		gw := gatewayFor(dst, net.ParseIP(r.VTEP))
+		if gw == nil {
+			return fmt.Errorf("vtep %q cannot reach %s", r.VTEP, prefix)
+		}
+		routers[gw.String()] = r.RouterMAC
+		fdb[r.RouterMAC] = r.VTEP
+	}
+	neigh, err := netlink.NeighList(m.svi.Attrs().Index, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("list neighbors on %s: %w", m.cfg.SVI, err)
+	}
+	currentNeigh := make(map[string]string)
+	for _, n := range neigh {
+		if n.IP == nil || n.Flags&netlink.NTF_EXT_LEARNED == 0 {
+			continue
+		}
+		currentNeigh[n.IP.String()] = n.HardwareAddr.String()
+	}
+	for gw, mac := range routers {
+		if currentNeigh[gw] != mac {
+			if err := setNeighbor(m.svi, gw, mac); err != nil {
+				return err
+			}
+		}
+		m.ownedNeigh[gw] = mac
+	}
+	if err := m.syncRouterFDB(fdb); err != nil {
+		return err
+	}
+
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Table: int(m.vrf.Table), Protocol: routeProtocol}, netlink.RT_FILTER_TABLE|netlink.RT_FILTER_PROTOCOL)
+	if err != nil {
+		return fmt.Errorf("list routes in vrf %s: %w", m.cfg.VRF, err)
+	}
+	current := make(map[string]net.IP, len(routes))
+	for _, r := range routes {
+		if r.Dst != nil {
+			current[r.Dst.String()] = r.Gw
+		}
+	}
+	for prefix, r := range desired {
+		_, dst, _ := net.ParseCIDR(prefix)
+		gw := gatewayFor(dst, net.ParseIP(r.VTEP))
+		if cur, ok := current[dst.String()]; ok && cur.Equal(gw) {
+			continue
+		}
+		route := &netlink.Route{
+			LinkIndex: m.svi.Attrs().Index,
+			Dst:       dst,
+			Gw:        gw,
+			Table:     int(m.vrf.Table),
+			Protocol:  routeProtocol,
+			Flags:     int(netlink.FLAG_ONLINK),
+		}
+		if err := netlink.RouteReplace(route); err != nil {
+			return fmt.Errorf("replace route %s via %s in vrf %s: %w", dst, gw, m.cfg.VRF, err)
+		}
+	}
+	for _, r := range routes {
+		if r.Dst == nil {
+			continue
+		}
+		if _, ok := desired[r.Dst.String()]; ok {
+			continue
+		}
+		if err := netlink.RouteDel(&r); err != nil {
+			return fmt.Errorf("delete route %s in vrf %s: %w", r.Dst, m.cfg.VRF, err)
+		}
+	}
+
+	for gw, mac := range currentNeigh {
+		if _, ok := routers[gw]; ok || m.ownedNeigh[gw] != mac {
+			continue
+		}
+		ip := net.ParseIP(gw)
+		if err := netlink.NeighDel(&netlink.Neigh{LinkIndex: m.svi.Attrs().Index, Family: familyOf(ip), IP: ip}); err != nil {
+			return fmt.Errorf("del neighbor %s on %s: %w", gw, m.cfg.SVI, err)
+		}
+	}
+	for gw := range m.ownedNeigh {
+		if _, ok := routers[gw]; !ok {
+			delete(m.ownedNeigh, gw)
+		}
+	}
+	return nil
+}
+
+func (m *L3Manager) syncRouterFDB(desired map[string]string) error {
+	neigh, err := netlink.NeighList(m.vxlan.Attrs().Index, syscall.AF_BRIDGE)
+	if err != nil {
+		return fmt.Errorf("list fdb on %s: %w", m.cfg.Device, err)
+	}
+	current := make(map[string]string)
+	for _, n := range neigh {
+		if n.IP == nil || len(n.HardwareAddr) != 6 || n.Flags&netlink.NTF_SELF == 0 {
+			continue
+		}
+		if bytes.Equal(n.HardwareAddr, broadcastMAC) {
+			continue
+		}
+		current[n.HardwareAddr.String()] = n.IP.String()
+	}
+	for mac, dst := range desired {
+		if current[mac] == dst {
+			m.ownedFDB[mac] = dst
+			continue
+		}
+		hw, err := net.ParseMAC(mac)
+		if err != nil {
+			return fmt.Errorf("invalid router mac %q: %w", mac, err)
+		}
+		n := &netlink.Neigh{
+			LinkIndex:    m.vxlan.Attrs().Index,
+			State:        netlink.NUD_NOARP,
+			Family:       syscall.AF_BRIDGE,
+			Flags:        netlink.NTF_SELF,
+			IP:           net.ParseIP(dst),
+			HardwareAddr: hw,
+		}
+		if err := netlink.NeighSet(n); err != nil {
+			return fmt.Errorf("add fdb %s dst %s on %s: %w", mac, dst, m.cfg.Device, err)
+		}
+		m.ownedFDB[mac] = dst
+	}
+	for mac, dst := range current {
+		if _, ok := desired[mac]; ok || m.ownedFDB[mac] != dst {
+			continue
+		}
+		hw, _ := net.ParseMAC(mac)
+		n := &netlink.Neigh{
+			LinkIndex:    m.vxlan.Attrs().Index,
+			Family:       syscall.AF_BRIDGE,
+			Flags:        netlink.NTF_SELF,
+			IP:           net.ParseIP(dst),
+			HardwareAddr: hw,
+		}
+		if err := netlink.NeighDel(n); err != nil {
+			return fmt.Errorf("del fdb %s dst %s on %s: %w", mac, dst, m.cfg.Device, err)
+		}
+	}
+	for mac := range m.ownedFDB {
+		if _, ok := desired[mac]; !ok {
+			delete(m.ownedFDB, mac)
+		}
+	}
+	return nil
+}
+
+// gatewayFor returns the next hop used for dst, or nil when the VTEP is of a
+// different address family than the prefix.
+func gatewayFor(dst *net.IPNet, vtep net.IP) net.IP {
+	if vtep == nil || (dst.IP.To4() == nil) != (vtep.To4() == nil) {
+		return nil
+	}
+	return vtep
+}
+
+// PickRemote chooses a deterministic forwarding entry when several VTEPs
+// advertise the same prefix.
+func PickRemote(candidates []RemotePrefix) RemotePrefix {
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].VTEP < candidates[j].VTEP })
+	return candidates[0]
+}
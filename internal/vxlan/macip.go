@@ -0,0 +1,223 @@
+package vxlan
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// MACIP is a local or remote MAC address with an optional IP binding.
+type MACIP struct {
+	MAC net.HardwareAddr
+	IP  net.IP
+}
+
+// Key returns a stable identifier for the binding.
+func (b MACIP) Key() string {
+	if b.IP == nil {
+		return b.MAC.String()
+	}
+	return b.MAC.String() + "|" + b.IP.String()
+}
+
+// LocalMACs returns the MAC/IP bindings that live behind the VXLAN device:
+// the overlay device's own MAC and addresses (the bridge when the VXLAN is
+// enslaved, the VXLAN itself otherwise), MACs learned on other bridge ports,
+// and IP bindings from the overlay device's neighbor table.
+func (m *Manager) LocalMACs() ([]MACIP, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.loadLink(); err != nil {
+		return nil, err
+	}
+	overlay, err := m.overlayLink()
+	if err != nil {
+		return nil, err
+	}
+	bridgeIndex := m.link.Attrs().MasterIndex
+
+	macs := make(map[string]net.HardwareAddr)
+	if own := overlay.Attrs().HardwareAddr; len(own) == 6 {
+		macs[own.String()] = own
+	}
+	if bridgeIndex != 0 {
+		fdb, err := netlink.NeighList(0, syscall.AF_BRIDGE)
+		if err != nil {
+			return nil, fmt.Errorf("list bridge fdb: %w", err)
+		}
+		for _, n := range fdb {
+			if n.MasterIndex != bridgeIndex || n.LinkIndex == m.link.Attrs().Index {
+				continue
+			}
+			if n.Flags&netlink.NTF_SELF != 0 || n.State&netlink.NUD_PERMANENT != 0 {
+				continue
+			}
+			if len(n.HardwareAddr) != 6 || isMulticast(n.HardwareAddr) {
+				continue
+			}
+			macs[n.HardwareAddr.String()] = n.HardwareAddr
+		}
+	}
+
+	bound := make(map[string]struct{})
+	var res []MACIP
+	addrs, err := netlink.AddrList(overlay, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("list addresses on %s: %w", overlay.Attrs().Name, err)
+	}
+	if own := overlay.Attrs().HardwareAddr; len(own) == 6 {
+		for _, addr := range addrs {
+			if addr.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			res = append(res, MACIP{MAC: own, IP: addr.IP})
+			bound[own.String()] = struct{}{}
+		}
+	}
+	neigh, err := netlink.NeighList(overlay.Attrs().Index, netlink.FAMILY_ALL)
+	if err != nil {
+		return nil, fmt.Errorf("list neighbors on %s: %w", overlay.Attrs().Name, err)
+	}
+	for _, n := range neigh {
+		if n.IP == nil || n.IP.IsLinkLocalUnicast() || len(n.HardwareAddr) != 6 {
+			continue
+		}
+		if n.State&(netlink.NUD_INCOMPLETE|netlink.NUD_FAILED) != 0 || n.Flags&netlink.NTF_EXT_LEARNED != 0 {
+			continue
+		}
+		mac, ok := macs[n.HardwareAddr.String()]
+		if !ok {
+			continue
+		}
+		res = append(res, MACIP{MAC: mac, IP: n.IP})
+		bound[mac.String()] = struct{}{}
+	}
+	for key, mac := range macs {
+		if _, ok := bound[key]; !ok {
+			res = append(res, MACIP{MAC: mac})
+		}
+	}
+	return res, nil
+}
+
+// SyncMACs ensures the unicast FDB entries on the VXLAN device match the
+// desired MAC -> remote VTEP mapping. Entries are installed as static
+// NTF_SELF entries, plus an NTF_MASTER entry when the device is a bridge port.
+func (m *Manager) SyncMACs(desired map[string]Endpoint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.loadLink(); err != nil {
+		return err
+	}
+	current, err := m.currentMACs()
+	if err != nil {
+		return err
+	}
+	for mac, dst := range desired {
+		dst.Port = m.fdbPort(dst.Port)
+		if !m.reachable(dst.IP) {
+			continue
+		}
+		if current[mac] != dst {
+			if err := m.addMAC(mac, dst); err != nil {
+				return err
+			}
+		}
+		m.ownedMACs[mac] = dst
+	}
+	// Only entries the agent owns are removed; static entries added by an
+	// operator and learned ones are left alone.
+	for mac, dst := range current {
+		if want, ok := desired[mac]; ok && m.reachable(want.IP) {
+			continue
+		}
+		if owned, ok := m.ownedMACs[mac]; !ok || owned != dst {
+			continue
+		}
+		if err := m.delMAC(mac, dst); err != nil {
+			return err
+		}
+	}
+	for mac := range m.ownedMACs {
+		if want, ok := desired[mac]; !ok || !m.reachable(want.IP) {
+			delete(m.ownedMACs, mac)
+		}
+	}
+	return nil
+}
+
+func (m *Manager) currentMACs() (map[string]Endpoint, error) {
+	entries, err := m.listFDB()
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]Endpoint)
+	for _, e := range entries {
+		if e.dst == nil || len(e.mac) != 6 || e.flags&netlink.NTF_SELF == 0 {
+			continue
+		}
+		if bytes.Equal(e.mac, broadcastMAC) || isMulticast(e.mac) {
+			continue
+		}
+		res[e.mac.String()] = Endpoint{IP: e.dst.String(), Port: e.port}
+	}
+	return res, nil
+}
+
+func (m *Manager) addMAC(mac string, dst Endpoint) error {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return fmt.Errorf("invalid mac %q: %w", mac, err)
+	}
+	ip := net.ParseIP(dst.IP)
+	if ip == nil {
+		return fmt.Errorf("invalid dst ip %q", dst.IP)
+	}
+	e := fdbEntry{mac: hw, dst: ip, port: dst.Port, state: netlink.NUD_NOARP, flags: netlink.NTF_SELF}
+	if err := m.writeFDB(unix.RTM_NEWNEIGH, unix.NLM_F_CREATE|unix.NLM_F_REPLACE, e); err != nil {
+		return fmt.Errorf("add fdb %s dst %s: %w", mac, dst.IP, err)
+	}
+	if m.link.Attrs().MasterIndex != 0 {
+		n := &netlink.Neigh{
+			LinkIndex:    m.link.Attrs().Index,
+			State:        netlink.NUD_NOARP,
+			Family:       syscall.AF_BRIDGE,
+			Flags:        netlink.NTF_MASTER,
+			HardwareAddr: hw,
+		}
+		if err := netlink.NeighSet(n); err != nil {
+			return fmt.Errorf("add bridge fdb %s: %w", mac, err)
+		}
+	}
+	return nil
+}
+
+func (m *Manager) delMAC(mac string, dst Endpoint) error {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return fmt.Errorf("invalid mac %q: %w", mac, err)
+	}
+	e := fdbEntry{mac: hw, dst: net.ParseIP(dst.IP), port: dst.Port, flags: netlink.NTF_SELF}
+	if err := m.writeFDB(unix.RTM_DELNEIGH, 0, e); err != nil {
+		return fmt.Errorf("del fdb %s dst %s: %w", mac, dst.IP, err)
+	}
+	if m.link.Attrs().MasterIndex != 0 {
+		n := &netlink.Neigh{
+			LinkIndex:    m.link.Attrs().Index,
+			Family:       syscall.AF_BRIDGE,
+			Flags:        netlink.NTF_MASTER,
+			HardwareAddr: hw,
+		}
+		// The bridge may already have aged or replaced the entry.
+		_ = netlink.NeighDel(n)
+	}
+	return nil
+}
+
+func isMulticast(mac net.HardwareAddr) bool {
+	return len(mac) > 0 && mac[0]&0x01 != 0
+}
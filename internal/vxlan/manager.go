@@ -1,33 +1,67 @@
 package vxlan
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"net"
-	"syscall"
+	"sync"
 
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 
 	"gobgp-evpn-agent/internal/config"
 )
 
 var broadcastMAC = net.HardwareAddr{0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
 
+// OwnerAlias is the interface alias marking VXLAN devices the agent created.
+// It survives agent restarts, so a later run still knows the device is its
+// own.
+const OwnerAlias = "evpn-agent"
+
 // Manager owns one VXLAN interface and its FDB entries.
+// Its exported methods are safe for concurrent use.
 type Manager struct {
+	// mu guards the cached link and the owned sets, and serializes
+	// kernel changes to the device.
+	mu       sync.Mutex
 	cfg      config.VNIConfig
 	port     uint16
 	localIP  net.IP
 	link     *netlink.Vxlan
 	linkOnce bool
+	// suppressIndex is the ifindex neigh_suppress was last enabled on, and
+	// suppressOwned whether the agent turned it on rather than finding it on.
+	suppressIndex int
+	suppressOwned bool
+	// ownedFDB, ownedMACs and ownedNeigh record the flood entries, unicast
+	// MAC entries and neighbors the agent programmed, or found already
+	// matching the desired state, so that cleanup removes nothing else.
+	ownedFDB   map[string]uint16
+	ownedMACs  map[string]Endpoint
+	ownedNeigh map[string]string
 }
 
 func NewManager(cfg config.VNIConfig, port uint16, localIP net.IP) *Manager {
-	return &Manager{cfg: cfg, port: port, localIP: localIP}
+	return &Manager{
+		cfg:        cfg,
+		port:       port,
+		localIP:    localIP,
+		ownedFDB:   make(map[string]uint16),
+		ownedMACs:  make(map[string]Endpoint),
+		ownedNeigh: make(map[string]string),
+	}
 }
 
 // LoadLink verifies the VXLAN interface exists and refreshes cached handle.
 func (m *Manager) LoadLink() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.loadLink()
+}
+
+func (m *Manager) loadLink() error {
 	link, err := netlink.LinkByName(m.cfg.Device)
 	if err != nil {
 		m.link = nil
@@ -43,104 +77,303 @@ func (m *Manager) LoadLink() error {
 	return nil
 }
 
-// SyncFDB ensures the FDB matches the desired remote VTEPs.
-func (m *Manager) SyncFDB(desired map[string]struct{}) error {
-	if err := m.LoadLink(); err != nil {
+// Create adds the VXLAN device from the VNI configuration: the VNI, local
+// address, UDP port and underlay device, with learning disabled and the
+// configured MTU. The device is tagged with OwnerAlias and brought up.
+func (m *Manager) Create() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.create(0)
+}
+
+// create adds the device, enslaved to master when it is not 0.
+func (m *Manager) create(master int) error {
+	attrs := netlink.NewLinkAttrs()
+	attrs.Name = m.cfg.Device
+	attrs.MTU = m.cfg.MTU
+	attrs.MasterIndex = master
+	vx := &netlink.Vxlan{
+		LinkAttrs: attrs,
+		VxlanId:   int(m.cfg.ID),
+		SrcAddr:   m.localIP,
+		Port:      int(m.port),
+		Learning:  false,
+	}
+	if m.cfg.UnderlayInterface != "" {
+		dev, err := netlink.LinkByName(m.cfg.UnderlayInterface)
+		if err != nil {
+			return fmt.Errorf("underlay %s: %w", m.cfg.UnderlayInterface, err)
+		}
+		vx.VtepDevIndex = dev.Attrs().Index
+	}
+	if err := netlink.LinkAdd(vx); err != nil {
+		return fmt.Errorf("create %s: %w", m.cfg.Device, err)
+	}
+	// The kernel ignores the alias on creation.
+	if err := netlink.LinkSetAlias(vx, OwnerAlias); err != nil {
+		_ = netlink.LinkDel(vx)
+		return fmt.Errorf("tag %s: %w", m.cfg.Device, err)
+	}
+	if err := netlink.LinkSetUp(vx); err != nil {
+		return fmt.Errorf("set %s up: %w", m.cfg.Device, err)
+	}
+	return m.loadLink()
+}
+
+// Recreate deletes the device and creates it again from the configuration,
+// on the same bridge. The FDB entries and neighbors of the old device go
+// with it.
+func (m *Manager) Recreate() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	master := 0
+	if err := m.loadLink(); err == nil {
+		master = m.link.Attrs().MasterIndex
+		if err := netlink.LinkDel(m.link); err != nil {
+			return fmt.Errorf("delete %s: %w", m.cfg.Device, err)
+		}
+	}
+	m.link = nil
+	m.linkOnce = false
+	m.suppressIndex = 0
+	m.ownedFDB = make(map[string]uint16)
+	m.ownedMACs = make(map[string]Endpoint)
+	m.ownedNeigh = make(map[string]string)
+	return m.create(master)
+}
+
+// Mismatches compares the loaded device with the configuration and returns
+// one reason per attribute that differs: the VNI, local address, UDP port,
+// learning, underlay device and MTU. A device bound to no underlay device
+// is accepted. It returns nil when the device is not loaded.
+func (m *Manager) Mismatches() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	vx := m.link
+	if vx == nil {
+		return nil
+	}
+	var reasons []string
+	if vx.VxlanId != int(m.cfg.ID) {
+		reasons = append(reasons, fmt.Sprintf("vni is %d, want %d", vx.VxlanId, m.cfg.ID))
+	}
+	if m.localIP != nil && !vx.SrcAddr.Equal(m.localIP) {
+		if vx.SrcAddr == nil {
+			reasons = append(reasons, fmt.Sprintf("local address unset, want %s", m.localIP))
+		} else {
+			reasons = append(reasons, fmt.Sprintf("local address is %s, want %s", vx.SrcAddr, m.localIP))
+		}
+	}
+	if m.port != 0 && vx.Port != int(m.port) {
+		reasons = append(reasons, fmt.Sprintf("dstport is %d, want %d", vx.Port, m.port))
+	}
+	if vx.Learning {
+		reasons = append(reasons, "learning is enabled, want nolearning")
+	}
+	if vx.VtepDevIndex != 0 && m.cfg.UnderlayInterface != "" {
+		if dev, err := netlink.LinkByName(m.cfg.UnderlayInterface); err == nil && dev.Attrs().Index != vx.VtepDevIndex {
+			have := fmt.Sprintf("ifindex %d", vx.VtepDevIndex)
+			if link, err := netlink.LinkByIndex(vx.VtepDevIndex); err == nil {
+				have = link.Attrs().Name
+			}
+			reasons = append(reasons, fmt.Sprintf("underlay device is %s, want %s", have, m.cfg.UnderlayInterface))
+		}
+	}
+	if m.cfg.MTU != 0 && vx.Attrs().MTU != m.cfg.MTU {
+		reasons = append(reasons, fmt.Sprintf("mtu is %d, want %d", vx.Attrs().MTU, m.cfg.MTU))
+	}
+	return reasons
+}
+
+// Owned reports whether the loaded device carries OwnerAlias.
+func (m *Manager) Owned() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.owned()
+}
+
+func (m *Manager) owned() bool {
+	return m.link != nil && m.link.Attrs().Alias == OwnerAlias
+}
+
+// Involves reports whether a neighbor or FDB event on the interface index,
+// enslaved to master, concerns the device: it is on the device itself, on
+// its bridge or on another port of its bridge.
+func (m *Manager) Involves(index, master int) bool {
+	m.mu.Lock()
+	link := m.link
+	m.mu.Unlock()
+	if link == nil {
+		return false
+	}
+	own, bridge := link.Attrs().Index, link.Attrs().MasterIndex
+	return index == own || bridge != 0 && (index == bridge || master == bridge)
+}
+
+// MTU returns the device MTU as last loaded, or 0.
+func (m *Manager) MTU() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.link == nil {
+		return 0
+	}
+	return m.link.Attrs().MTU
+}
+
+// SyncFDB ensures the FDB matches the desired remote VTEPs, which map to
+// the UDP port each listens on (0 for the device's port). VTEPs of the
+// other address family than the device's underlay are skipped, as the
+// kernel cannot reach them from this device. Only flood entries the agent
+// programmed are removed; one added by hand stays.
+func (m *Manager) SyncFDB(desired map[string]uint16) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.loadLink(); err != nil {
 		return err
 	}
 	current, err := m.currentFDB()
 	if err != nil {
 		return err
 	}
-	for dst := range desired {
-		if _, ok := current[dst]; !ok {
-			if err := m.add(dst); err != nil {
+	for dst, port := range desired {
+		if !m.reachable(dst) {
+			continue
+		}
+		port = m.fdbPort(port)
+		have, ok := current[dst]
+		if ok && have == port {
+			m.ownedFDB[dst] = port
+			continue
+		}
+		if ok {
+			// The remote moved to another port.
+			if err := m.del(dst, have); err != nil {
 				return err
 			}
 		}
+		if err := m.add(dst, port); err != nil {
+			return err
+		}
+		m.ownedFDB[dst] = port
 	}
-	for dst := range current {
-		if _, ok := desired[dst]; !ok {
-			if err := m.del(dst); err != nil {
-				return err
-			}
+	for dst, port := range current {
+		if _, ok := desired[dst]; ok && m.reachable(dst) {
+			continue
+		}
+		if owned, ok := m.ownedFDB[dst]; !ok || owned != port {
+			continue
+		}
+		if err := m.del(dst, port); err != nil {
+			return err
+		}
+	}
+	for dst := range m.ownedFDB {
+		if _, ok := desired[dst]; !ok || !m.reachable(dst) {
+			delete(m.ownedFDB, dst)
 		}
 	}
 	return nil
 }
 
-// Close removes the VXLAN interface if it was created by the manager.
+// Close removes the VXLAN interface if it was created by the agent.
+// Devices created by anyone else are left alone.
 func (m *Manager) Close() error {
-	if m.link == nil {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.loadLink(); err != nil || !m.owned() {
 		return nil
 	}
 	return netlink.LinkDel(m.link)
 }
 
-func (m *Manager) currentFDB() (map[string]struct{}, error) {
-	res := make(map[string]struct{})
-	if m.link == nil {
-		return res, errors.New("vxlan link not ready")
-	}
-	neigh, err := netlink.NeighList(m.link.Attrs().Index, syscall.AF_BRIDGE)
-	if err != nil {
-		return nil, fmt.Errorf("list fdb: %w", err)
+// FlushFDB removes the flood entries, unicast MAC entries and neighbors the
+// agent programmed on the device and leaves any other entry alone.
+func (m *Manager) FlushFDB() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.loadLink(); err != nil {
+		return nil
 	}
-	for _, n := range neigh {
-		if n.IP == nil || n.HardwareAddr == nil {
-			continue
-		}
-		if len(n.HardwareAddr) != len(broadcastMAC) {
-			continue
+	var errs []error
+	if current, err := m.currentFDB(); err != nil {
+		errs = append(errs, err)
+	} else {
+		for dst, port := range current {
+			if owned, ok := m.ownedFDB[dst]; ok && owned == port {
+				errs = append(errs, m.del(dst, port))
+			}
 		}
-		match := true
-		for i := range broadcastMAC {
-			if n.HardwareAddr[i] != broadcastMAC[i] {
-				match = false
-				break
+	}
+	if current, err := m.currentMACs(); err != nil {
+		errs = append(errs, err)
+	} else {
+		for mac, dst := range current {
+			if m.ownedMACs[mac] == dst {
+				errs = append(errs, m.delMAC(mac, dst))
 			}
 		}
-		if !match {
+	}
+	errs = append(errs, m.flushNeighbors())
+	m.ownedFDB = make(map[string]uint16)
+	m.ownedMACs = make(map[string]Endpoint)
+	m.ownedNeigh = make(map[string]string)
+	return errors.Join(errs...)
+}
+
+// reachable reports whether dst shares the address family of the device's
+// local tunnel address, falling back to the agent's VTEP address.
+func (m *Manager) reachable(dst string) bool {
+	ip := net.ParseIP(dst)
+	if ip == nil {
+		return false
+	}
+	local := m.localIP
+	if m.link != nil && m.link.SrcAddr != nil {
+		local = m.link.SrcAddr
+	}
+	if local == nil {
+		return true
+	}
+	return (ip.To4() == nil) == (local.To4() == nil)
+}
+
+// currentFDB returns the flood entries of the device with their ports.
+func (m *Manager) currentFDB() (map[string]uint16, error) {
+	entries, err := m.listFDB()
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]uint16)
+	for _, e := range entries {
+		if e.dst == nil || !bytes.Equal(e.mac, broadcastMAC) {
 			continue
 		}
-		res[n.IP.String()] = struct{}{}
+		res[e.dst.String()] = e.port
 	}
 	return res, nil
 }
 
-func (m *Manager) add(dst string) error {
+func (m *Manager) add(dst string, port uint16) error {
 	ip := net.ParseIP(dst)
 	if ip == nil {
 		return fmt.Errorf("invalid dst ip %q", dst)
 	}
-	n := &netlink.Neigh{
-		LinkIndex:    m.link.Attrs().Index,
-		State:        netlink.NUD_PERMANENT,
-		Family:       syscall.AF_BRIDGE,
-		Flags:        netlink.NTF_SELF,
-		IP:           ip,
-		HardwareAddr: broadcastMAC,
-	}
-	// Use Append to allow multiple flood entries (same MAC, different dst) without replace errors.
-	if err := netlink.NeighAppend(n); err != nil {
+	// Append allows multiple flood entries (same MAC, different dst)
+	// without replace errors.
+	e := fdbEntry{mac: broadcastMAC, dst: ip, port: port, state: netlink.NUD_PERMANENT, flags: netlink.NTF_SELF}
+	if err := m.writeFDB(unix.RTM_NEWNEIGH, unix.NLM_F_CREATE|unix.NLM_F_APPEND, e); err != nil {
 		return fmt.Errorf("add fdb %s: %w", dst, err)
 	}
 	return nil
 }
 
-func (m *Manager) del(dst string) error {
+func (m *Manager) del(dst string, port uint16) error {
 	ip := net.ParseIP(dst)
 	if ip == nil {
 		return fmt.Errorf("invalid dst ip %q", dst)
 	}
-	n := &netlink.Neigh{
-		LinkIndex:    m.link.Attrs().Index,
-		Family:       syscall.AF_BRIDGE,
-		Flags:        netlink.NTF_SELF,
-		IP:           ip,
-		HardwareAddr: broadcastMAC,
-	}
-	if err := netlink.NeighDel(n); err != nil {
+	e := fdbEntry{mac: broadcastMAC, dst: ip, port: port, flags: netlink.NTF_SELF}
+	if err := m.writeFDB(unix.RTM_DELNEIGH, 0, e); err != nil {
 		return fmt.Errorf("del fdb %s: %w", dst, err)
 	}
 	return nil
@@ -0,0 +1,117 @@
+package vxlan
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+
+	"gobgp-evpn-agent/internal/config"
+)
+
+// testManager creates a VXLAN device for the test, or skips the test when
+// links cannot be created here.
+func testManager(t *testing.T, id uint32) *Manager {
+	t.Helper()
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to create links")
+	}
+	m := NewManager(config.VNIConfig{ID: id, Device: fmt.Sprintf("vxtest%d", id)}, 4789, net.ParseIP("10.0.0.1"))
+	if err := m.Create(); err != nil {
+		if errors.Is(err, syscall.EPERM) || errors.Is(err, syscall.EOPNOTSUPP) {
+			t.Skipf("cannot create vxlan: %v", err)
+		}
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if link, err := netlink.LinkByName(m.cfg.Device); err == nil {
+			_ = netlink.LinkDel(link)
+		}
+	})
+	return m
+}
+
+func TestSyncFDBOwnership(t *testing.T) {
+	// A step either syncs to fdb or, for "add" and "del", edits the FDB
+	// behind the manager's back as an operator would.
+	type step struct {
+		op  string
+		fdb map[string]uint16
+	}
+	tests := []struct {
+		name  string
+		steps []step
+		want  map[string]uint16
+	}{
+		{
+			name: "unowned entry survives",
+			steps: []step{
+				{"add", map[string]uint16{"10.0.0.5": 0}},
+				{"sync", map[string]uint16{"10.0.0.2": 0}},
+			},
+			want: map[string]uint16{"10.0.0.2": 0, "10.0.0.5": 0},
+		},
+		{
+			name: "owned entry removed when no longer desired",
+			steps: []step{
+				{"sync", map[string]uint16{"10.0.0.2": 0, "10.0.0.3": 0}},
+				{"sync", map[string]uint16{"10.0.0.2": 0}},
+			},
+			want: map[string]uint16{"10.0.0.2": 0},
+		},
+		{
+			name: "entry rewritten by hand survives",
+			steps: []step{
+				{"sync", map[string]uint16{"10.0.0.3": 0}},
+				{"del", map[string]uint16{"10.0.0.3": 0}},
+				{"add", map[string]uint16{"10.0.0.3": 8472}},
+				{"sync", nil},
+			},
+			want: map[string]uint16{"10.0.0.3": 8472},
+		},
+		{
+			name: "matching entry found is owned",
+			steps: []step{
+				{"add", map[string]uint16{"10.0.0.5": 0}},
+				{"sync", map[string]uint16{"10.0.0.5": 0}},
+				{"sync", nil},
+			},
+			want: map[string]uint16{},
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := testManager(t, uint32(4000+i))
+			for j, s := range tt.steps {
+				var err error
+				switch s.op {
+				case "sync":
+					err = m.SyncFDB(s.fdb)
+				case "add", "del":
+					for dst, port := range s.fdb {
+						if s.op == "add" {
+							err = m.add(dst, port)
+						} else {
+							err = m.del(dst, port)
+						}
+					}
+				}
+				if err != nil {
+					t.Fatalf("step %d %s: %v", j, s.op, err)
+				}
+			}
+			got, err := m.currentFDB()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("fdb = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
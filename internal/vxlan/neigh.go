@@ -0,0 +1,188 @@
+package vxlan
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+)
+
+// EnableNeighSuppress turns on neigh_suppress on the VXLAN bridge port so the
+// bridge answers ARP/ND from its neighbor table instead of flooding. It is a
+// no-op for devices that are not enslaved to a bridge. A port found with
+// neigh_suppress already on is left to whoever set it.
+func (m *Manager) EnableNeighSuppress() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.loadLink(); err != nil {
+		return err
+	}
+	idx := m.link.Attrs().Index
+	if m.link.Attrs().MasterIndex == 0 || m.suppressIndex == idx {
+		return nil
+	}
+	info, err := netlink.LinkGetProtinfo(m.link)
+	if err != nil {
+		return fmt.Errorf("read protinfo of %s: %w", m.cfg.Device, err)
+	}
+	m.suppressOwned = !info.NeighSuppress
+	if m.suppressOwned {
+		if err := netlink.LinkSetBrNeighSuppress(m.link, true); err != nil {
+			return fmt.Errorf("enable neigh_suppress on %s: %w", m.cfg.Device, err)
+		}
+	}
+	m.suppressIndex = idx
+	return nil
+}
+
+// DisableNeighSuppress undoes EnableNeighSuppress for a VNI whose
+// arpSuppress is off: it turns neigh_suppress off again when the agent
+// turned it on for the current device, and removes the neighbors
+// SyncNeighbors installed. A port the agent never touched is left alone.
+func (m *Manager) DisableNeighSuppress() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.loadLink(); err != nil {
+		return err
+	}
+	var errs []error
+	if m.suppressOwned && m.suppressIndex == m.link.Attrs().Index && m.link.Attrs().MasterIndex != 0 {
+		if err := netlink.LinkSetBrNeighSuppress(m.link, false); err != nil {
+			errs = append(errs, fmt.Errorf("disable neigh_suppress on %s: %w", m.cfg.Device, err))
+		}
+	}
+	m.suppressIndex = 0
+	m.suppressOwned = false
+	if err := m.flushNeighbors(); err != nil {
+		errs = append(errs, err)
+	} else {
+		m.ownedNeigh = make(map[string]string)
+	}
+	return errors.Join(errs...)
+}
+
+// SyncNeighbors installs remote IP -> MAC bindings as NOARP neighbor entries
+// on the overlay device (the bridge when enslaved, the VXLAN otherwise) and
+// removes stale ones. Only entries flagged extern_learn are managed, and
+// only those this manager installed are removed, so kernel-resolved
+// neighbors and those of other VNIs or daemons on a shared bridge are left
+// alone.
+func (m *Manager) SyncNeighbors(desired map[string]string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.loadLink(); err != nil {
+		return err
+	}
+	overlay, err := m.overlayLink()
+	if err != nil {
+		return err
+	}
+	neigh, err := netlink.NeighList(overlay.Attrs().Index, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("list neighbors on %s: %w", overlay.Attrs().Name, err)
+	}
+	current := make(map[string]string)
+	for _, n := range neigh {
+		if n.IP == nil || n.Flags&netlink.NTF_EXT_LEARNED == 0 {
+			continue
+		}
+		current[n.IP.String()] = n.HardwareAddr.String()
+	}
+	for ip, mac := range desired {
+		if current[ip] != mac {
+			if err := setNeighbor(overlay, ip, mac); err != nil {
+				return err
+			}
+		}
+		m.ownedNeigh[ip] = mac
+	}
+	for ip, mac := range current {
+		if _, ok := desired[ip]; ok || m.ownedNeigh[ip] != mac {
+			continue
+		}
+		n := &netlink.Neigh{
+			LinkIndex: overlay.Attrs().Index,
+			Family:    familyOf(net.ParseIP(ip)),
+			IP:        net.ParseIP(ip),
+		}
+		if err := netlink.NeighDel(n); err != nil {
+			return fmt.Errorf("del neighbor %s on %s: %w", ip, overlay.Attrs().Name, err)
+		}
+	}
+	for ip := range m.ownedNeigh {
+		if _, ok := desired[ip]; !ok {
+			delete(m.ownedNeigh, ip)
+		}
+	}
+	return nil
+}
+
+// flushNeighbors removes the neighbors SyncNeighbors installed that still
+// carry the MAC it set.
+func (m *Manager) flushNeighbors() error {
+	if len(m.ownedNeigh) == 0 {
+		return nil
+	}
+	overlay, err := m.overlayLink()
+	if err != nil {
+		return err
+	}
+	neigh, err := netlink.NeighList(overlay.Attrs().Index, netlink.FAMILY_ALL)
+	if err != nil {
+		return fmt.Errorf("list neighbors on %s: %w", overlay.Attrs().Name, err)
+	}
+	for _, n := range neigh {
+		if n.IP == nil || n.Flags&netlink.NTF_EXT_LEARNED == 0 || m.ownedNeigh[n.IP.String()] != n.HardwareAddr.String() {
+			continue
+		}
+		del := &netlink.Neigh{LinkIndex: overlay.Attrs().Index, Family: familyOf(n.IP), IP: n.IP}
+		if err := netlink.NeighDel(del); err != nil {
+			return fmt.Errorf("del neighbor %s on %s: %w", n.IP, overlay.Attrs().Name, err)
+		}
+	}
+	return nil
+}
+
+// overlayLink returns the device that carries overlay IPs: the bridge the
+// VXLAN is enslaved to, or the VXLAN itself.
+func (m *Manager) overlayLink() (netlink.Link, error) {
+	if idx := m.link.Attrs().MasterIndex; idx != 0 {
+		br, err := netlink.LinkByIndex(idx)
+		if err != nil {
+			return nil, fmt.Errorf("lookup bridge of %s: %w", m.cfg.Device, err)
+		}
+		return br, nil
+	}
+	return m.link, nil
+}
+
+func setNeighbor(link netlink.Link, ip, mac string) error {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return fmt.Errorf("invalid neighbor ip %q", ip)
+	}
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return fmt.Errorf("invalid neighbor mac %q: %w", mac, err)
+	}
+	n := &netlink.Neigh{
+		LinkIndex:    link.Attrs().Index,
+		Family:       familyOf(addr),
+		State:        netlink.NUD_NOARP,
+		Flags:        netlink.NTF_EXT_LEARNED,
+		IP:           addr,
+		HardwareAddr: hw,
+	}
+	if err := netlink.NeighSet(n); err != nil {
+		return fmt.Errorf("set neighbor %s lladdr %s on %s: %w", ip, mac, link.Attrs().Name, err)
+	}
+	return nil
+}
+
+func familyOf(ip net.IP) int {
+	if ip.To4() != nil {
+		return netlink.FAMILY_V4
+	}
+	return netlink.FAMILY_V6
+}